@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Imaging backends selectable with the --backend flag or "backend"
+// config key
+const (
+	autoBackend   = "auto"   // first of magick, gm, vips found on PATH, else go
+	magickBackend = "magick" // ImageMagick's convert & identify programs
+	gmBackend     = "gm"     // GraphicsMagick's gm convert & gm identify
+	vipsBackend   = "vips"   // libvips' vips & vipsheader programs
+	goBackend     = "go"     // built-in, no external programs required
+)
+
+// jpegQuality is the quality JPGs are encoded with. Close to what
+// ImageMagick uses by default.
+const jpegQuality = 92
+
+// tileSide is the side of a square 1MP tile, 1024x1024, about the
+// Garmin limit.
+const tileSide = 1024
+
+// ImageBackend does the image work process and processBig need. JPGs
+// written are stripped of metadata and baseline (not progressive or
+// interlaced) as Garmins require.
+type ImageBackend interface {
+	// Identify returns the width and height of the image file in pixels
+	Identify(imageFilename string) (width int, height int, err error)
+
+	// Resize scales inFile to about maxPixArea pixels (w x h),
+	// preserving its aspect ratio, and writes it as a JPG.
+	Resize(outFile, inFile string, maxPixArea int) error
+
+	// Normalize re-writes inFile as a JPG without resizing it.
+	Normalize(outFile, inFile string) error
+
+	// Crop cuts fixedJpg into the JPG tiles of the layout written
+	// to outDir as <baseName>_tile_NNN.jpg. Numbering starts at
+	// 000 in the top left (NW) going eastwards, then down a row
+	// to the bottom right (SE), so the tile files sort in that
+	// order. Rightmost tiles may be narrower and bottom ones
+	// shorter.
+	Crop(fixedJpg, outDir, baseName string, tl tileLayout) error
+
+	// Extract writes the pixel rectangle r of inFile, which must be
+	// within it, to outFile as a JPG.
+	Extract(outFile, inFile string, r image.Rectangle) error
+}
+
+// newImageBackend returns the ImageBackend of the given name. The
+// "auto" backend picks the first of ImageMagick, GraphicsMagick and
+// vips that is installed, falling back to the built-in go backend.
+func newImageBackend(name string) (ImageBackend, error) {
+	switch name {
+	case "", autoBackend:
+		for _, b := range []string{magickBackend, gmBackend, vipsBackend} {
+			if ib, err := newImageBackend(b); err == nil {
+				return ib, nil
+			}
+		}
+		return goImager{}, nil
+	case magickBackend:
+		return lookExecImager(execImager{name: name, convert: []string{"convert"}, identify: []string{"identify"}})
+	case gmBackend:
+		return lookExecImager(execImager{name: name, convert: []string{"gm", "convert"}, identify: []string{"gm", "identify"}})
+	case vipsBackend:
+		for _, p := range []string{"vips", "vipsheader"} {
+			if _, err := exec.LookPath(p); err != nil {
+				return nil, fmt.Errorf("Backend %q needs %q on your PATH: %v", name, p, err)
+			}
+		}
+		return vipsImager{}, nil
+	case goBackend:
+		return goImager{}, nil
+	}
+	return nil, fmt.Errorf("Unknown imaging backend %q, must be one of %v", name,
+		[]string{autoBackend, magickBackend, gmBackend, vipsBackend, goBackend})
+}
+
+// lookExecImager returns ei if its programs are on the PATH
+func lookExecImager(ei execImager) (ImageBackend, error) {
+	for _, p := range []string{ei.convert[0], ei.identify[0]} {
+		if _, err := exec.LookPath(p); err != nil {
+			return nil, fmt.Errorf("Backend %q needs %q on your PATH: %v", ei.name, p, err)
+		}
+	}
+	return ei, nil
+}
+
+// run runs the given program and args, logging it first
+func run(prog []string, args ...string) ([]byte, error) {
+	cmd := exec.Command(prog[0], append(append([]string{}, prog[1:]...), args...)...)
+	glog.Infof("About to run: %#v\n", cmd.Args)
+	b, err := cmd.Output()
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return b, fmt.Errorf("%v: %s", err, bytes.TrimSpace(ee.Stderr))
+	}
+	return b, err
+}
+
+// parseWxH parses the "<width> <height>" identify programs output
+func parseWxH(b []byte) (width int, height int, err error) {
+	wh := strings.Fields(string(b))
+	if len(wh) != 2 {
+		return 0, 0, fmt.Errorf("Expected two ints separated by space, but got: %q", b)
+	}
+	if width, err = strconv.Atoi(wh[0]); err != nil {
+		return
+	}
+	height, err = strconv.Atoi(wh[1])
+	return
+}
+
+// execImager is an ImageBackend using ImageMagick or GraphicsMagick
+// programs, which take the same arguments for what we do.
+type execImager struct {
+	name     string
+	convert  []string // e.g. "convert" or "gm convert"
+	identify []string // e.g. "identify" or "gm identify"
+}
+
+func (ei execImager) String() string { return ei.name }
+
+func (ei execImager) Identify(imageFilename string) (width int, height int, err error) {
+	if _, err := os.Stat(imageFilename); os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	// [0] so multi-frame or multi-page images report just the first
+	b, err := run(ei.identify, "-format", "%w %h", imageFilename+"[0]")
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseWxH(b)
+}
+
+func (ei execImager) Resize(outFile, inFile string, maxPixArea int) error {
+	_, err := run(ei.convert, execResizeArgs(outFile, inFile, maxPixArea)...)
+	return err
+}
+
+func (ei execImager) Normalize(outFile, inFile string) error {
+	_, err := run(ei.convert, execNormalizeArgs(outFile, inFile)...)
+	return err
+}
+
+func (ei execImager) Crop(fixedJpg, outDir, baseName string, tl tileLayout) error {
+	_, err := run(ei.convert, execCropArgs(fixedJpg, outDir, baseName, tl)...)
+	return err
+}
+
+func (ei execImager) Extract(outFile, inFile string, r image.Rectangle) error {
+	_, err := run(ei.convert, execExtractArgs(outFile, inFile, r)...)
+	return err
+}
+
+// execResizeArgs returns the convert args for execImager.Resize
+func execResizeArgs(outFile, inFile string, maxPixArea int) []string {
+	// param order super sensitive
+	return []string{"-resize", "@" + fmt.Sprintf("%v", maxPixArea), inFile, "-strip", "-interlace", "none", outFile}
+}
+
+// execNormalizeArgs returns the convert args for execImager.Normalize
+func execNormalizeArgs(outFile, inFile string) []string {
+	return []string{inFile, "-strip", "-interlace", "none", outFile}
+}
+
+// execCropArgs returns the convert args for execImager.Crop
+func execCropArgs(fixedJpg, outDir, baseName string, tl tileLayout) []string {
+	// numbered as per tileFile
+	outFile := filepath.Join(outDir, baseName+"_tile_%03d.jpg")
+	return []string{"-crop", fmt.Sprintf("%dx%d", tl.width, tl.height), fixedJpg, "+adjoin", outFile}
+}
+
+// execExtractArgs returns the convert args for execImager.Extract
+func execExtractArgs(outFile, inFile string, r image.Rectangle) []string {
+	// +repage so the JPG doesn't keep the offset into inFile
+	return []string{inFile, "-crop", fmt.Sprintf("%dx%d+%d+%d", r.Dx(), r.Dy(), r.Min.X, r.Min.Y),
+		"+repage", "-strip", "-interlace", "none", outFile}
+}
+
+// vipsImager is an ImageBackend using the libvips command line
+// programs. Lighter on memory than ImageMagick for very large images.
+type vipsImager struct{}
+
+func (vipsImager) String() string { return vipsBackend }
+
+// vipsJpg is the vips output file name for a stripped, baseline JPG
+func vipsJpg(outFile string) string {
+	return fmt.Sprintf("%s[Q=%d,strip,interlace=false]", outFile, jpegQuality)
+}
+
+func (vipsImager) Identify(imageFilename string) (width int, height int, err error) {
+	if _, err := os.Stat(imageFilename); os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	var wh []byte
+	for _, f := range []string{"width", "height"} {
+		b, err := run([]string{"vipsheader"}, "-f", f, imageFilename)
+		if err != nil {
+			return 0, 0, err
+		}
+		wh = append(append(wh, bytes.TrimSpace(b)...), ' ')
+	}
+	return parseWxH(wh)
+}
+
+func (vi vipsImager) Resize(outFile, inFile string, maxPixArea int) error {
+	w, h, err := vi.Identify(inFile)
+	if err != nil {
+		return err
+	}
+	_, err = run([]string{"vips"}, vipsResizeArgs(outFile, inFile, w, h, maxPixArea)...)
+	return err
+}
+
+func (vipsImager) Normalize(outFile, inFile string) error {
+	_, err := run([]string{"vips"}, "copy", inFile, vipsJpg(outFile))
+	return err
+}
+
+func (vi vipsImager) Crop(fixedJpg, outDir, baseName string, tl tileLayout) error {
+	w, h, err := vi.Identify(fixedJpg)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < tl.tiles(); i++ {
+		r := tl.tileRect(i, image.Rect(0, 0, w, h))
+		if err = vi.Extract(tileFile(outDir, baseName, i), fixedJpg, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vipsImager) Extract(outFile, inFile string, r image.Rectangle) error {
+	_, err := run([]string{"vips"}, vipsExtractArgs(outFile, inFile, r)...)
+	return err
+}
+
+// vipsResizeArgs returns the vips args for vipsImager.Resize of a
+// width x height inFile
+func vipsResizeArgs(outFile, inFile string, width, height, maxPixArea int) []string {
+	scale := math.Sqrt(float64(maxPixArea) / float64(width*height))
+	return []string{"resize", inFile, vipsJpg(outFile), strconv.FormatFloat(scale, 'f', -1, 64)}
+}
+
+// vipsExtractArgs returns the vips args for vipsImager.Extract, which
+// Crop uses for each tile too
+func vipsExtractArgs(outFile, inFile string, r image.Rectangle) []string {
+	return []string{"crop", inFile, vipsJpg(outFile),
+		strconv.Itoa(r.Min.X), strconv.Itoa(r.Min.Y), strconv.Itoa(r.Dx()), strconv.Itoa(r.Dy())}
+}
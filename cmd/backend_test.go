@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"image"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewImageBackend(t *testing.T) {
+	if _, err := newImageBackend("photoshop"); err == nil {
+		t.Errorf("expected error for unknown backend")
+	}
+	ib, err := newImageBackend(goBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ib.(goImager); !ok {
+		t.Errorf("go backend is %T", ib)
+	}
+	// auto gives whichever is installed, go if none are
+	if ib, err = newImageBackend(autoBackend); err != nil || ib == nil {
+		t.Errorf("auto backend gave %v, %v", ib, err)
+	}
+}
+
+func TestParseWxH(t *testing.T) {
+	vals := []struct {
+		out           string
+		width, height int
+		ok            bool
+	}{
+		{"1500 1200", 1500, 1200, true},
+		{"1500 1200\n", 1500, 1200, true}, // gm identify
+		{"1500 1200 ", 1500, 1200, true},  // vipsheader widths & heights joined
+		{"1500", 0, 0, false},
+		{"1500x1200", 0, 0, false},
+		{"wide 1200", 0, 0, false},
+	}
+	for _, v := range vals {
+		w, h, err := parseWxH([]byte(v.out))
+		if v.ok && (err != nil || w != v.width || h != v.height) {
+			t.Errorf("%q: got %d, %d, %v", v.out, w, h, err)
+		}
+		if !v.ok && err == nil {
+			t.Errorf("%q: expected error", v.out)
+		}
+	}
+}
+
+func TestExecImagerArgs(t *testing.T) {
+	vals := []struct {
+		got, want []string
+	}{
+		{execResizeArgs("out.jpg", "in.tif", 1048576),
+			[]string{"-resize", "@1048576", "in.tif", "-strip", "-interlace", "none", "out.jpg"}},
+		{execNormalizeArgs("out.jpg", "in.png"),
+			[]string{"in.png", "-strip", "-interlace", "none", "out.jpg"}},
+		{execCropArgs("fixed.jpg", "tiles", "map", tileLayout{cols: 3, rows: 2, width: 1000, height: 1048}),
+			[]string{"-crop", "1000x1048", "fixed.jpg", "+adjoin", filepath.Join("tiles", "map_tile_%03d.jpg")}},
+		{execExtractArgs("out.jpg", "in.jpg", image.Rect(10, 20, 110, 70)),
+			[]string{"in.jpg", "-crop", "100x50+10+20", "+repage", "-strip", "-interlace", "none", "out.jpg"}},
+	}
+	for _, v := range vals {
+		if !reflect.DeepEqual(v.got, v.want) {
+			t.Errorf("got %q, want %q", v.got, v.want)
+		}
+	}
+}
+
+func TestVipsImagerArgs(t *testing.T) {
+	vals := []struct {
+		got, want []string
+	}{
+		{vipsResizeArgs("out.jpg", "in.tif", 4000, 1000, 1000000),
+			[]string{"resize", "in.tif", "out.jpg[Q=92,strip,interlace=false]", "0.5"}},
+		{vipsExtractArgs("out.jpg", "in.jpg", image.Rect(10, 20, 110, 70)),
+			[]string{"crop", "in.jpg", "out.jpg[Q=92,strip,interlace=false]", "10", "20", "100", "50"}},
+	}
+	for _, v := range vals {
+		if !reflect.DeepEqual(v.got, v.want) {
+			t.Errorf("got %q, want %q", v.got, v.want)
+		}
+	}
+}
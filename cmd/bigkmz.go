@@ -27,6 +27,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -44,14 +45,45 @@ device limitations. It is intended for higher resolution producing
 KMZs for use on Google Earth and other apps that can handle large
 images.
 
-Input is the same name-geo-anchored JPG file as can be used with the
-kmz subcommand.  For example using the same JPG file you can create a
+Input is the same name-geo-anchored JPG file, or image with a world
+file, as can be used with the kmz subcommand. Projected maps are
+reprojected to lat/long the same way too, in memory, see --src_crs, and maps that
+are not north-up placed with --rotation or --corners. Map collars can
+be cropped off with --crop_pixels or --crop_box.  For example using the same JPG file you can create a
 KMZ for your Garmin with kmz subcom, and another KMZ with the bigkmz
 subcommand for your PC.  E.g. in the Search and Rescue context, team
 members can have the map on their GPSs in the field and a SAR manager
 can use the bigkmz on Google Earth at the command post.
 
+To stack overlays cleanly, clip a map to its neat line or a search
+area with --clip, giving the polygons of a KML, KMZ or GeoJSON file or
+the lat,long points of one, e.g.
+
+    cutkmz bigkmz --clip sector4.kml Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+Everything outside the polygons is transparent, so the overlay is a
+PNG rather than a JPG. Holes (KML innerBoundaryIs) are left out too.
+
+Set the overlay's opacity and tint with --opacity and --tint, or per
+map in the config file, as for the kmz subcommand.
+
+Very large scans, 200 megapixels say, are slow for Google Earth to
+load as one image. With --pyramid the image is cut into 256x256 tiles
+(or 512x512, see --pyramid_tile) at full resolution, then again at
+half, quarter etc. resolution down to one tile for the whole map. Each
+tile has a KML with a Region, linked to from the tile above it, so
+Earth loads the coarse tiles when zoomed out and only the fine tiles
+in view when zoomed in.
+
+Scans calibrated in OziExplorer are placed by their .map file, e.g.
+mymap.map for mymap.jpg, using its calibration points, datum and
+Latitude/Longitude or UTM projection. Maps not north-up are placed by
+their corners, as with --corners. For volunteers using Ozi, --ozi_map
+also writes the KMZ's image next to it, e.g. mymap-big.jpg, with a
+mymap-big.map calibrating it in WGS 84.
+
 `,
+	PreRun: bindFlags,
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := processBig(viper.GetViper(), args); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -70,9 +102,42 @@ func init() {
 	bigkmzCmd.Flags().IntP("drawing_order", "d", 51, "Garmins make values > 50 visible. Tune if have overlapping overlays.")
 	viper.BindPFlag("drawing_order", bigkmzCmd.Flags().Lookup("drawing_order"))
 
+	bigkmzCmd.Flags().Float64("opacity", defaultOpacity, "Overlay opacity, from 0 (invisible) to 1 (opaque).")
+	viper.BindPFlag("opacity", bigkmzCmd.Flags().Lookup("opacity"))
+
+	bigkmzCmd.Flags().String("tint", defaultTint, "Overlay tint as rrggbb hex. ffffff leaves the map's colours as they are.")
+	viper.BindPFlag("tint", bigkmzCmd.Flags().Lookup("tint"))
+
 	bigkmzCmd.Flags().BoolP("keep_tmp", "k", false, "Don't delete intermediate files from $TMPDIR.")
 	viper.BindPFlag("keep_tmp", bigkmzCmd.Flags().Lookup("keep_tmp"))
 
+	bigkmzCmd.Flags().Int("src_crs", 0, "EPSG code of a projected world file or GeoTIFF, e.g. 32610 for UTM zone 10N. Reprojects to lat/long.")
+	viper.BindPFlag("src_crs", bigkmzCmd.Flags().Lookup("src_crs"))
+
+	bigkmzCmd.Flags().Float64("rotation", 0, "Degrees counter-clockwise the map's box is rotated about its centre to fit the map.")
+	viper.BindPFlag("rotation", bigkmzCmd.Flags().Lookup("rotation"))
+
+	bigkmzCmd.Flags().String("corners", "", "Map corners lat,long in NW,NE,SE,SW order instead of a box, for maps not north-up. 8 comma separated decimal degrees.")
+	viper.BindPFlag("corners", bigkmzCmd.Flags().Lookup("corners"))
+
+	bigkmzCmd.Flags().String("crop_pixels", "", "Crop the map's collar off: left,top,right,bottom pixels of the image to keep.")
+	viper.BindPFlag("crop_pixels", bigkmzCmd.Flags().Lookup("crop_pixels"))
+
+	bigkmzCmd.Flags().String("crop_box", "", "Crop the map's collar off: north,south,east,west decimal degrees of the map to keep.")
+	viper.BindPFlag("crop_box", bigkmzCmd.Flags().Lookup("crop_box"))
+
+	bigkmzCmd.Flags().String("clip", "", "Make the map transparent outside a polygon: a .kml, .kmz or .geojson file, or lat,long,lat,long,... points. Writes a PNG.")
+	viper.BindPFlag("clip", bigkmzCmd.Flags().Lookup("clip"))
+
+	bigkmzCmd.Flags().Bool("pyramid", false, "Cut the image into a pyramid of tiles at successive resolutions so Google Earth loads only the detail in view.")
+	viper.BindPFlag("pyramid", bigkmzCmd.Flags().Lookup("pyramid"))
+
+	bigkmzCmd.Flags().Int("pyramid_tile", 256, "With --pyramid, the side of its square tiles in pixels, 256 or 512.")
+	viper.BindPFlag("pyramid_tile", bigkmzCmd.Flags().Lookup("pyramid_tile"))
+
+	bigkmzCmd.Flags().Bool("ozi_map", false, "Also write the KMZ's image and an OziExplorer .map file for it next to the KMZ.")
+	viper.BindPFlag("ozi_map", bigkmzCmd.Flags().Lookup("ozi_map"))
+
 	bigkmzCmd.Flags().AddGoFlagSet(flag.CommandLine)
 	flag.CommandLine.VisitAll(func(f *flag.Flag) {
 		viper.BindPFlag(f.Name, bigkmzCmd.Flags().Lookup(f.Name))
@@ -86,16 +151,59 @@ func init() {
 // The max_pixels (width x height) can be used to reduce quality to
 // desired pixel araea.  0, the default, means unlimited/leave the
 // image as is.
+//
+// With "clip", the image is made transparent outside the clip
+// polygon and put in the KMZ as a PNG. With "pyramid", it is cut into
+// a Region pyramid as per buildPyramid. Overlay colours are as per
+// mapColor. With "ozi_map", the image is also written next to the KMZ
+// with an OziExplorer .map file.
 func processBig(v *viper.Viper, args []string) error {
 	maxPixels := v.GetInt("max_pixels")
 	keepTmp := v.GetBool("keep_tmp")
 	drawingOrder := v.GetInt("drawing_order")
+	srcCRS := v.GetInt("src_crs")
+	rotation := v.GetFloat64("rotation")
+	pyramid := v.GetBool("pyramid")
+	pyramidTile := v.GetInt("pyramid_tile")
+	oziMap := v.GetBool("ozi_map")
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("keep_tmp: %v, maxPixels: %v, drawing_order %v\n", keepTmp, maxPixels, drawingOrder)
+	fmt.Printf("keep_tmp: %v, maxPixels: %v, drawing_order %v, backend: %v, src_crs: %v, rotation: %v, pyramid: %v\n", keepTmp, maxPixels, drawingOrder, ib, srcCRS, rotation, pyramid)
 
 	if len(args) == 0 {
 		return fmt.Errorf("Image file required: must provide one or more imaage file path")
 	}
+	quad, hasQuad, err := cornersFlag(v, ib, rotation, args)
+	if err != nil {
+		return err
+	}
+	crop, err := cropFlags(v, rotation, hasQuad, args)
+	if err != nil {
+		return err
+	}
+	var clip clipPolygon
+	if c := v.GetString("clip"); c != "" {
+		if rotation != 0 || hasQuad {
+			return fmt.Errorf("Clipping is not supported for maps placed with a rotation or corners")
+		}
+		if clip, err = parseClip(c); err != nil {
+			return err
+		}
+	}
+	if oziMap && rotation != 0 {
+		return fmt.Errorf("OziExplorer .map files can't be written for maps placed with a rotation, give --corners instead")
+	}
+	if pyramid {
+		if rotation != 0 || hasQuad || clip != nil {
+			return fmt.Errorf("Pyramids are not supported for maps placed with a rotation or corners, or clipped")
+		}
+		if !validPyramidTile(pyramidTile) {
+			return fmt.Errorf("Pyramid tiles must be one of %v pixels square, got %d", pyramidTileSides, pyramidTile)
+		}
+	}
 
 	for _, image := range args {
 		if _, err := os.Stat(image); os.IsNotExist(err) {
@@ -105,18 +213,31 @@ func processBig(v *viper.Viper, args []string) error {
 		if err != nil {
 			return fmt.Errorf("Issue with an image file path: %v", err)
 		}
-		base, box, err := getBox(absImage)
-		if err != nil {
-			return fmt.Errorf("Error with image file name: %v", err)
-		}
-		origMap, err := newMapTileFromFile(absImage, box[north], box[south], box[east], box[west])
+		base, box, crs, err := quadOrMapBox(ib, absImage, srcCRS, quad, hasQuad)
 		if err != nil {
-			return fmt.Errorf("Error extracting image dimensions: %v", err)
+			return fmt.Errorf("Error with image bounding box: %v", err)
 		}
 		tmpDir, err := ioutil.TempDir("", "cutkmz-")
 		if err != nil {
 			return fmt.Errorf("Error creating a temporary directory: %v", err)
 		}
+		if absImage, box, err = crop.cropPixels(ib, tmpDir, absImage, box, crs == 0); err != nil {
+			return fmt.Errorf("Error cropping image: %v", err)
+		}
+		if crs != 0 {
+			warped := filepath.Join(tmpDir, "warped.jpg")
+			if box, err = warpToLatLong(warped, absImage, box, crs); err != nil {
+				return fmt.Errorf("Error reprojecting image to lat/long: %v", err)
+			}
+			absImage = warped
+		}
+		if absImage, box, err = crop.cropBox(ib, tmpDir, absImage, box); err != nil {
+			return fmt.Errorf("Error cropping image: %v", err)
+		}
+		origMap, err := newMapTileFromFile(ib, absImage, box[north], box[south], box[east], box[west])
+		if err != nil {
+			return fmt.Errorf("Error extracting image dimensions: %v", err)
+		}
 		tilesDir := filepath.Join(tmpDir, base, "tiles")
 		err = os.MkdirAll(tilesDir, 0755)
 		if err != nil {
@@ -125,50 +246,82 @@ func processBig(v *viper.Viper, args []string) error {
 
 		fixedJpg := filepath.Join(tilesDir, base+"_tile_000.jpg") // one tile
 		if maxPixels > 0 && maxPixels < (origMap.height*origMap.width) {
-			resizeFixToJpg(fixedJpg, absImage, maxPixels)
+			if err = ib.Resize(fixedJpg, absImage, maxPixels); err != nil {
+				return fmt.Errorf("Error resizing image: %v", err)
+			}
 		} else {
-			// just copy the file, no de-interlace or stripping
-			var in, out *os.File
-			if out, err = os.Create(fixedJpg); err != nil {
+			jpg, err := isJpeg(absImage)
+			if err != nil {
 				return err
 			}
-			if in, err = os.Open(absImage); err != nil {
-				return err
+			if jpg {
+				// just copy the file, no de-interlace or stripping
+				if err = copyFile(fixedJpg, absImage); err != nil {
+					return err
+				}
+			} else if err = ib.Normalize(fixedJpg, absImage); err != nil {
+				// TIFFs, PNGs etc. placed by world files, GeoTIFF
+				// tags or .map files
+				return fmt.Errorf("Error converting image to JPG: %v", err)
 			}
-			if _, err = io.Copy(out, in); err != nil {
+		}
+
+		if clip != nil {
+			clipped := strings.TrimSuffix(fixedJpg, ".jpg") + ".png"
+			if err = clipToPng(clipped, fixedJpg, box, clip); err != nil {
+				return fmt.Errorf("Error clipping image: %v", err)
+			}
+			if err = os.Remove(fixedJpg); err != nil {
 				return err
 			}
+			fixedJpg = clipped
 		}
 
-		fixedMap, err := newMapTileFromFile(fixedJpg, box[north], box[south], box[east], box[west])
+		fixedMap, err := newMapTileFromFile(ib, fixedJpg, box[north], box[south], box[east], box[west])
 		if err != nil {
 			return err
 		}
 
-		var kdocWtr *os.File
-
-		if kdocWtr, err = os.Create(filepath.Join(tmpDir, base, "doc.kml")); err != nil {
-			return err
-		}
-		if err = startKML(kdocWtr, base); err != nil {
+		color, err := mapColor(v, base)
+		if err != nil {
 			return err
 		}
 
-		var relTPath string // file ref inside KML must be relative to kmz root
-		if relTPath, err = filepath.Rel(filepath.Join(tmpDir, base), fixedMap.fpath); err != nil {
-			return err
+		if oziMap {
+			corners := boxQuad(fixedMap.box[:])
+			if hasQuad {
+				corners = quad
+			}
+			if err = writeOziImage(base+"-big"+filepath.Ext(fixedJpg), fixedJpg, base, fixedMap.width, fixedMap.height, corners); err != nil {
+				return err
+			}
+			fmt.Println(base + "-big.map")
 		}
-		if err = kmlAddOverlay(kdocWtr, base, fixedMap.box, drawingOrder, relTPath); err != nil {
-			return err
+
+		kmzDir := filepath.Join(tmpDir, base)
+		var doc *kmlDocument
+		if pyramid {
+			if doc, err = buildPyramid(ib, fixedJpg, tmpDir, kmzDir, base, fixedMap.box[:], pyramidTile, drawingOrder, color); err != nil {
+				return err
+			}
+			if err = os.Remove(fixedJpg); err != nil {
+				return err
+			}
+		} else {
+			var relTPath string // file ref inside KML must be relative to kmz root
+			if relTPath, err = filepath.Rel(kmzDir, fixedMap.fpath); err != nil {
+				return err
+			}
+			doc = &kmlDocument{Name: base}
+			if hasQuad {
+				doc.Overlays = append(doc.Overlays, newKMLQuadOverlay(base, quad, drawingOrder, color, relTPath))
+			} else {
+				doc.Overlays = append(doc.Overlays, newKMLOverlay(base, fixedMap.box, rotation, drawingOrder, color, relTPath))
+			}
 		}
-		endKML(kdocWtr)
-		kdocWtr.Close()
-		var zf *os.File
-		if zf, err = os.Create(base + "-big.kmz"); err != nil {
+		if err = writeKMZ(base+"-big.kmz", kmzDir, doc); err != nil {
 			return err
 		}
-		zipd(filepath.Join(tmpDir, base), zf)
-		zf.Close()
 
 		if !keepTmp {
 			err = os.RemoveAll(tmpDir)
@@ -179,3 +332,18 @@ func processBig(v *viper.Viper, args []string) error {
 	}
 	return nil
 }
+
+// isJpeg returns true if the file is a JPEG, going by its first bytes
+// rather than its name
+func isJpeg(fpath string) (bool, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var b [3]byte
+	if _, err = io.ReadFull(f, b[:]); err != nil {
+		return false, nil // too short to be one
+	}
+	return b == [3]byte{0xff, 0xd8, 0xff}, nil
+}
@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// clipRing is a closed ring of lat/long points, indexed by cornerLat
+// and cornerLon like quad corners. The last point joins the first.
+type clipRing [][2]float64
+
+// clipPolygon is the area of a map to keep, everything outside it
+// made transparent. A point is inside if it is inside an odd number
+// of rings, so inner rings make holes.
+type clipPolygon []clipRing
+
+// parseClip returns the polygon given by --clip: a .kml, .kmz,
+// .geojson or .json file, or at least three comma separated lat,long
+// decimal degree points, e.g. "49.47,-123.14,49.48,-122.98,49.33,-122.97"
+func parseClip(s string) (clipPolygon, error) {
+	var cp clipPolygon
+	var err error
+	switch strings.ToLower(filepath.Ext(s)) {
+	case ".kml", ".kmz":
+		cp, err = readKMLPolygons(s)
+	case ".geojson", ".json":
+		cp, err = readGeoJSONPolygons(s)
+	default:
+		cp, err = parseClipPoints(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(cp) == 0 {
+		return nil, fmt.Errorf("No polygons found in %v", s)
+	}
+	return cp, nil
+}
+
+// parseClipPoints parses comma separated lat,long points into a ring
+func parseClipPoints(s string) (clipPolygon, error) {
+	c := strings.Split(s, ",")
+	if len(c) < 6 || len(c)%2 != 0 {
+		return nil, fmt.Errorf("Clip polygon must be a file or at least 3 comma separated lat,long points, got %q", s)
+	}
+	var ring clipRing
+	for i := 0; i < len(c); i += 2 {
+		lat, err := strconv.ParseFloat(strings.TrimSpace(c[i]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing clip polygon degrees: %v", err)
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(c[i+1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing clip polygon degrees: %v", err)
+		}
+		if ring, err = ring.add(lat, lon); err != nil {
+			return nil, err
+		}
+	}
+	return clipPolygon{ring}, nil
+}
+
+// add returns the ring with the given point added, or an error if it
+// is not a lat/long
+func (r clipRing) add(lat, lon float64) (clipRing, error) {
+	if lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("Clip polygon latitudes must be in [-90,90], got %v", lat)
+	}
+	return append(r, [2]float64{lat, normEasting(lon)}), nil
+}
+
+// readKMLPolygons returns the rings of every Polygon's boundaries in
+// the given KML file, or the doc.kml of the given KMZ
+func readKMLPolygons(fpath string) (clipPolygon, error) {
+	var r io.ReadCloser
+	if strings.EqualFold(filepath.Ext(fpath), ".kml") {
+		f, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	} else {
+		zr, err := zip.OpenReader(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening KMZ %v: %v", fpath, err)
+		}
+		defer zr.Close()
+		doc, err := kmzDocKML(&zr.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Error with KMZ %v: %v", fpath, err)
+		}
+		if r, err = doc.Open(); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Close()
+	return readKMLRings(r)
+}
+
+// readKMLRings returns the LinearRings of the Polygons in the KML
+// read from r, however deeply they are nested
+func readKMLRings(r io.Reader) (clipPolygon, error) {
+	var cp clipPolygon
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return cp, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing KML: %v", err)
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "LinearRing" {
+			continue
+		}
+		var lr struct {
+			Coordinates string `xml:"coordinates"`
+		}
+		if err = d.DecodeElement(&lr, &se); err != nil {
+			return nil, fmt.Errorf("Error parsing KML LinearRing: %v", err)
+		}
+		// KML coordinates are long,lat[,alt] tuples
+		var ring clipRing
+		for _, tuple := range strings.Fields(lr.Coordinates) {
+			c := strings.Split(tuple, ",")
+			if len(c) < 2 {
+				return nil, fmt.Errorf("Bad KML coordinates %q", tuple)
+			}
+			lon, err := strconv.ParseFloat(c[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing KML coordinates: %v", err)
+			}
+			lat, err := strconv.ParseFloat(c[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing KML coordinates: %v", err)
+			}
+			if ring, err = ring.add(lat, lon); err != nil {
+				return nil, err
+			}
+		}
+		if len(ring) >= 3 {
+			cp = append(cp, ring)
+		}
+	}
+}
+
+// geoJSON is the part of a GeoJSON object, be it a FeatureCollection,
+// Feature or geometry, that holds polygons
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []*geoJSON      `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []*geoJSON      `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// readGeoJSONPolygons returns the rings of the Polygons and
+// MultiPolygons in the given GeoJSON file
+func readGeoJSONPolygons(fpath string) (clipPolygon, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	var g geoJSON
+	if err = json.Unmarshal(b, &g); err != nil {
+		return nil, fmt.Errorf("Error parsing GeoJSON %v: %v", fpath, err)
+	}
+	return g.rings()
+}
+
+// rings returns the rings of the polygons in the object and those it
+// contains. GeoJSON positions are [long, lat].
+func (g *geoJSON) rings() (clipPolygon, error) {
+	var cp clipPolygon
+	var polys [][][][]float64
+	switch g.Type {
+	case "FeatureCollection":
+		for _, f := range g.Features {
+			r, err := f.rings()
+			if err != nil {
+				return nil, err
+			}
+			cp = append(cp, r...)
+		}
+		return cp, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.rings()
+	case "GeometryCollection":
+		for _, gg := range g.Geometries {
+			r, err := gg.rings()
+			if err != nil {
+				return nil, err
+			}
+			cp = append(cp, r...)
+		}
+		return cp, nil
+	case "Polygon":
+		var p [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, fmt.Errorf("Error parsing GeoJSON Polygon: %v", err)
+		}
+		polys = append(polys, p)
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &polys); err != nil {
+			return nil, fmt.Errorf("Error parsing GeoJSON MultiPolygon: %v", err)
+		}
+	}
+	for _, p := range polys {
+		for _, positions := range p {
+			var ring clipRing
+			for _, pos := range positions {
+				if len(pos) < 2 {
+					return nil, fmt.Errorf("Bad GeoJSON position %v", pos)
+				}
+				var err error
+				if ring, err = ring.add(pos[1], pos[0]); err != nil {
+					return nil, err
+				}
+			}
+			if len(ring) >= 3 {
+				cp = append(cp, ring)
+			}
+		}
+	}
+	return cp, nil
+}
+
+// clipToPng writes inFile, covering the lat/long box, to outFile as a
+// PNG with everything outside the polygon transparent. An error if
+// none of the image is inside it.
+func clipToPng(outFile, inFile string, box []float64, cp clipPolygon) error {
+	src, err := decodeImage(inFile)
+	if err != nil {
+		return err
+	}
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	glog.Infof("Clipping %v to %d rings as %v\n", inFile, len(cp), outFile)
+
+	latPerPix := (box[north] - box[south]) / float64(b.Dy())
+	lonPerPix := eastDelta(box[east], box[west]) / float64(b.Dx())
+	kept := 0
+	for y := 0; y < b.Dy(); y++ {
+		spans := cp.spans(box[north]-(float64(y)+0.5)*latPerPix, box[west])
+		for i := 0; i+1 < len(spans); i += 2 {
+			// pixels whose centres are within the span
+			x0 := int(math.Max(0, math.Ceil(spans[i]/lonPerPix-0.5)))
+			x1 := int(math.Min(float64(b.Dx()), math.Ceil(spans[i+1]/lonPerPix-0.5)))
+			if x0 >= x1 {
+				continue
+			}
+			r := image.Rect(x0, y, x1, y+1)
+			draw.Draw(dst, r, src, b.Min.Add(r.Min), draw.Src)
+			kept += x1 - x0
+		}
+	}
+	if kept == 0 {
+		return fmt.Errorf("Clip polygon does not overlap the map's box %v", box)
+	}
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	if err = png.Encode(f, dst); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// spans returns the sorted longitudes, in degrees east of west, where
+// the parallel at lat crosses the polygon's edges. Pairs of them are
+// the spans inside the polygon.
+func (cp clipPolygon) spans(lat, west float64) []float64 {
+	var xs []float64
+	for _, ring := range cp {
+		for i := range ring {
+			a, b := ring[i], ring[(i+1)%len(ring)]
+			if (a[cornerLat] > lat) == (b[cornerLat] > lat) {
+				continue
+			}
+			// longitudes relative to a's so crossing 180 works
+			dlon := normEasting(b[cornerLon] - a[cornerLon])
+			f := (lat - a[cornerLat]) / (b[cornerLat] - a[cornerLat])
+			x := normEasting(a[cornerLon] + f*dlon - west)
+			xs = append(xs, x)
+		}
+	}
+	sort.Float64s(xs)
+	return xs
+}
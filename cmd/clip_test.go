@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseClipPoints(t *testing.T) {
+	cp, err := parseClip("49.5,-123, 49.5,-122,49,-122.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp) != 1 || len(cp[0]) != 3 || cp[0][2] != [2]float64{49, -122.5} {
+		t.Errorf("got %v", cp)
+	}
+	for _, s := range []string{"49,-123,50,-122", "49,-123,50,-122,48", "91,0,0,0,1,1", "a,b,c,d,e,f"} {
+		if _, err := parseClip(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestReadKMLRings(t *testing.T) {
+	kml := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document><Folder><Placemark>
+  <Polygon>
+    <outerBoundaryIs><LinearRing><coordinates>
+      -123,49,0 -122,49,0 -122,50,0 -123,50,0 -123,49,0
+    </coordinates></LinearRing></outerBoundaryIs>
+    <innerBoundaryIs><LinearRing><coordinates>-122.6,49.4 -122.4,49.4 -122.5,49.6</coordinates></LinearRing></innerBoundaryIs>
+  </Polygon>
+</Placemark></Folder></Document></kml>`
+	cp, err := readKMLRings(strings.NewReader(kml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp) != 2 || len(cp[0]) != 5 || len(cp[1]) != 3 {
+		t.Fatalf("got %v", cp)
+	}
+	if cp[0][1] != [2]float64{49, -122} {
+		t.Errorf("got %v, want lat,long", cp[0][1])
+	}
+}
+
+func TestReadGeoJSONPolygons(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gj := `{"type": "FeatureCollection", "features": [
+  {"type": "Feature", "properties": {}, "geometry": {"type": "Polygon",
+    "coordinates": [[[-123, 49], [-122, 49], [-122, 50], [-123, 49]]]}},
+  {"type": "Feature", "properties": {}, "geometry": {"type": "MultiPolygon",
+    "coordinates": [[[[10, 1], [11, 1], [11, 2], [10, 1]]], [[[20, 1], [21, 1], [21, 2], [20, 1]]]]}},
+  {"type": "Feature", "properties": {}, "geometry": {"type": "Point", "coordinates": [1, 2]}}
+]}`
+	fpath := filepath.Join(dir, "area.geojson")
+	if err = ioutil.WriteFile(fpath, []byte(gj), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := parseClip(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp) != 3 || cp[0][1] != [2]float64{49, -122} || cp[2][0] != [2]float64{1, 20} {
+		t.Errorf("got %v", cp)
+	}
+}
+
+func TestClipToPng(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "map.jpg")
+	gray := image.NewGray(image.Rect(0, 0, 100, 100))
+	for i := range gray.Pix {
+		gray.Pix[i] = 128
+	}
+	if err = writeJpg(src, gray, jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+
+	// a diamond inside the map's box with a square hole, crossing 180
+	box := []float64{10, 0, -175, 175}
+	cp := clipPolygon{
+		{{10, 180}, {5, -175}, {0, 180}, {5, 175}},
+		{{6, 179}, {6, -179}, {4, -179}, {4, 179}},
+	}
+	out := filepath.Join(dir, "map.png")
+	if err = clipToPng(out, src, box, cp); err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeImage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpha := func(x, y int) uint8 { return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).A }
+	for _, p := range []struct {
+		x, y int
+		a    uint8
+	}{
+		{0, 0, 0}, {99, 99, 0}, {99, 0, 0}, // corners outside the diamond
+		{50, 20, 255}, {20, 50, 255}, {80, 50, 255}, // inside
+		{50, 50, 0}, // in the hole
+	} {
+		if a := alpha(p.x, p.y); a != p.a {
+			t.Errorf("pixel %d,%d alpha %d, want %d", p.x, p.y, a, p.a)
+		}
+	}
+
+	if err = clipToPng(out, src, box, clipPolygon{{{50, 0}, {50, 1}, {49, 1}}}); err == nil {
+		t.Errorf("expected error for polygon outside the map")
+	}
+}
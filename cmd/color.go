@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// defaultOpacity is how opaque overlays are by default, about the
+// bdffffff colour KMZs have always had
+const defaultOpacity = 0.74
+
+// defaultTint is the colour overlays are tinted by default, white
+// leaving them as they are
+const defaultTint = "ffffff"
+
+// kmlColor returns the KML aabbggrr colour of the given opacity in
+// [0,1] and rrggbb hex tint, which may start with a #
+func kmlColor(opacity float64, tint string) (string, error) {
+	if opacity < 0 || opacity > 1 || math.IsNaN(opacity) {
+		return "", fmt.Errorf("Opacity must be in [0,1], got %v", opacity)
+	}
+	t := strings.ToLower(strings.TrimPrefix(tint, "#"))
+	if _, err := strconv.ParseUint(t, 16, 32); err != nil || len(t) != 6 {
+		return "", fmt.Errorf("Tint must be a rrggbb hex colour such as ff8000, got %q", tint)
+	}
+	return fmt.Sprintf("%02x%s%s%s", int(math.Round(opacity*255)), t[4:6], t[2:4], t[0:2]), nil
+}
+
+// mapColor returns the KML colour of the named map's overlays: its
+// "opacity" and "tint" under "maps.<name>" in the config file if
+// given, otherwise those of the "opacity" and "tint" viper keys, e.g.
+//
+//   opacity: 0.8
+//   maps:
+//     Grouse-Mountain:
+//       opacity: 1
+//       tint: ffe0e0
+func mapColor(v *viper.Viper, name string) (string, error) {
+	opacity, tint := defaultOpacity, defaultTint
+	if v.IsSet("opacity") {
+		opacity = v.GetFloat64("opacity")
+	}
+	if v.IsSet("tint") {
+		tint = v.GetString("tint")
+	}
+	key := "maps." + strings.ToLower(name)
+	if v.IsSet(key + ".opacity") {
+		opacity = v.GetFloat64(key + ".opacity")
+	}
+	if v.IsSet(key + ".tint") {
+		tint = v.GetString(key + ".tint")
+	}
+	c, err := kmlColor(opacity, tint)
+	if err != nil {
+		return "", fmt.Errorf("Map %v: %v", name, err)
+	}
+	return c, nil
+}
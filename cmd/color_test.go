@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestKMLColor(t *testing.T) {
+	tests := []struct {
+		opacity float64
+		tint    string
+		want    string
+	}{
+		{defaultOpacity, defaultTint, "bdffffff"},
+		{1, "ff8000", "ff0080ff"},
+		{0, "#123456", "00563412"},
+		{0.5, "ABCDEF", "80efcdab"},
+	}
+	for _, tt := range tests {
+		c, err := kmlColor(tt.opacity, tt.tint)
+		if err != nil {
+			t.Errorf("%v %q: unexpected error %v", tt.opacity, tt.tint, err)
+		} else if c != tt.want {
+			t.Errorf("%v %q: got %v, want %v", tt.opacity, tt.tint, c, tt.want)
+		}
+	}
+	for _, bad := range []struct {
+		opacity float64
+		tint    string
+	}{{-0.1, defaultTint}, {1.1, defaultTint}, {math.NaN(), defaultTint}, {1, "fff"}, {1, "ggffff"}, {1, "ff00ff00"}, {1, "+fffff"}} {
+		if _, err := kmlColor(bad.opacity, bad.tint); err == nil {
+			t.Errorf("%v %q: expected error", bad.opacity, bad.tint)
+		}
+	}
+}
+
+func TestMapColor(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	cfg := `
+opacity: 0.5
+maps:
+  Grouse-Mountain:
+    opacity: 1
+    tint: ff0000
+  Seymour:
+    tint: 00ff00
+  Bad:
+    opacity: 2
+`
+	if err := v.ReadConfig(strings.NewReader(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"Grouse-Mountain": "ff0000ff", "Seymour": "8000ff00", "Cypress": "80ffffff"} {
+		c, err := mapColor(v, name)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", name, err)
+		} else if c != want {
+			t.Errorf("%v: got %v, want %v", name, c, want)
+		}
+	}
+	if _, err := mapColor(v, "Bad"); err == nil {
+		t.Errorf("expected error for opacity 2")
+	}
+	if c, err := mapColor(viper.New(), "Cypress"); err != nil || c != "bdffffff" {
+		t.Errorf("got %v %v, want default bdffffff", c, err)
+	}
+}
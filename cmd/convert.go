@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/image/draw"
+)
+
+// convertCmd represents the convert command
+var convertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Makes a KMZ or KML from another tool into one a Garmin can use",
+	Long: `Reads the GroundOverlays of each given KMZ or KML, such as a Google
+Earth export, and writes a KMZ that meets the Garmin limits (see
+'cutkmz kmz -h'):
+
+    cutkmz convert Trailhead.kmz
+
+creates Trailhead-garmin.kmz in the current directory.
+
+Each overlay's image is flattened onto white if it has transparency,
+re-encoded as a baseline JPEG and chopped into the fewest tiles of
+up to the --device's max tile pixels (1MP). If the tiles of all the
+overlays would be more than the device allows (or --max_tiles), every
+image is reduced by the same amount until they fit. Overlays keep
+their LatLonBox and rotation, and their drawOrders relative to each
+other starting at the device's (or --drawing_order). Everything goes
+in a single /doc.kml. With --skip_blank, tiles of a single colour,
+such as transparent margins flattened to white, are left out and the
+tiles saved spent on the rest.
+
+The overlays of every KML in a KMZ are converted, those its doc.kml's
+NetworkLinks load and any in subdirectories as well as doc.kml's own.
+
+Overlays placed with a gx:LatLonQuad or with images that are not in
+the KMZ (e.g. http links) are not supported.
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processConvert(viper.GetViper(), args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz convert -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(convertCmd)
+
+	convertCmd.Flags().String("device", defaultDevice, "GPS model whose limits to meet: "+deviceNames()+", or one from the config file.")
+	viper.BindPFlag("device", convertCmd.Flags().Lookup("device"))
+
+	convertCmd.Flags().IntP("max_tiles", "t", 0, "max tiles in all. 0 means the device's limit.")
+	viper.BindPFlag("max_tiles", convertCmd.Flags().Lookup("max_tiles"))
+
+	convertCmd.Flags().IntP("drawing_order", "d", 0, "drawOrder of the lowest overlay. Garmins make values > 50 visible. 0 means the device's default.")
+	viper.BindPFlag("drawing_order", convertCmd.Flags().Lookup("drawing_order"))
+
+	convertCmd.Flags().Bool("skip_blank", false, "Drop tiles of a single colour and spend the tiles saved on more detail for the rest.")
+	viper.BindPFlag("skip_blank", convertCmd.Flags().Lookup("skip_blank"))
+
+	convertCmd.Flags().Int("blank_tolerance", defaultBlankTolerance, "With --skip_blank, how much a tile's colours may vary, 0-255 per channel, and still be blank.")
+	viper.BindPFlag("blank_tolerance", convertCmd.Flags().Lookup("blank_tolerance"))
+
+	convertCmd.Flags().BoolP("keep_tmp", "k", false, "Don't delete intermediate files from $TMPDIR.")
+	viper.BindPFlag("keep_tmp", convertCmd.Flags().Lookup("keep_tmp"))
+
+	convertCmd.Flags().String("name", "", "map name. Default is the KMZ file's name with -garmin added.")
+	viper.BindPFlag("name", convertCmd.Flags().Lookup("name"))
+
+	convertCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, convertCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// processConvert writes a Garmin compatible KMZ for each KMZ or KML in
+// args. Uses "device", "max_tiles", "drawing_order", "keep_tmp",
+// "name", "skip_blank" and "blank_tolerance" from viper if present.
+func processConvert(v *viper.Viper, args []string) error {
+	keepTmp := v.GetBool("keep_tmp")
+	name := v.GetString("name")
+	skipBlank := v.GetBool("skip_blank")
+	blankTolerance := v.GetInt("blank_tolerance")
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
+	dev, err := deviceFromFlags(v)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("KMZ file required: must provide one or more KMZ or KML file path")
+	}
+	if len(args) > 1 && name != "" {
+		return fmt.Errorf("Only one KMZ at a time can be converted with a --name")
+	}
+	if blankTolerance < 0 || blankTolerance > 255 {
+		return fmt.Errorf("Blank tolerance must be in [0,255], got %d", blankTolerance)
+	}
+	for _, kmz := range args {
+		base := name
+		if base == "" {
+			base = strings.TrimSuffix(filepath.Base(kmz), filepath.Ext(kmz)) + "-garmin"
+		}
+		base = strings.Replace(base, "_", "-", -1)
+		tmpDir, err := ioutil.TempDir("", "cutkmz-")
+		if err != nil {
+			return fmt.Errorf("Error creating a temporary directory: %v", err)
+		}
+		if err = convertKMZ(ib, kmz, base, tmpDir, dev, skipBlank, blankTolerance); err != nil {
+			return fmt.Errorf("Error converting %v: %v", kmz, err)
+		}
+		if !keepTmp {
+			if err = os.RemoveAll(tmpDir); err != nil {
+				return fmt.Errorf("Error removing tmp dir & contents: %v", err)
+			}
+		}
+		fmt.Println(base + ".kmz")
+	}
+	return nil
+}
+
+// convertKMZ re-tiles the overlays of the given KMZ or KML into
+// base.kmz in the current directory for the device, working in
+// tmpDir. Blank tiles are dropped if skipBlank.
+func convertKMZ(ib ImageBackend, kmz, base, tmpDir string, dev *device, skipBlank bool, blankTolerance int) error {
+	out, err := filepath.Abs(base + ".kmz")
+	if err != nil {
+		return err
+	}
+	if in, err := filepath.Abs(kmz); err != nil || in == out {
+		return fmt.Errorf("Not overwriting %v, give another --name", kmz)
+	}
+
+	// open returns the image an overlay's href refers to
+	var overlays []*kmlGroundOverlay
+	var open func(href string) (io.ReadCloser, error)
+	if strings.EqualFold(filepath.Ext(kmz), ".kml") {
+		if overlays, err = readKMZOverlays(kmz); err != nil {
+			return err
+		}
+		open = func(href string) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(filepath.Dir(kmz), filepath.FromSlash(href)))
+		}
+	} else {
+		zr, zoverlays, err := openKMZ(kmz)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		overlays = zoverlays
+		files := kmzFiles(&zr.Reader)
+		open = func(href string) (io.ReadCloser, error) {
+			if zf := files[path.Clean(href)]; zf != nil {
+				return zf.Open()
+			}
+			return nil, fmt.Errorf("Image %v is not in the KMZ", href)
+		}
+	}
+	if len(overlays) == 0 {
+		return fmt.Errorf("No GroundOverlays found")
+	}
+
+	srcDir := filepath.Join(tmpDir, "src")
+	if err = os.MkdirAll(srcDir, 0755); err != nil {
+		return fmt.Errorf("Error making dir in tmp dir: %v", err)
+	}
+	jobs := make([]*tileJob, len(overlays))
+	sizes := make([]image.Point, len(overlays))
+	minOrder := math.MaxInt32
+	for i, o := range overlays {
+		if o.LatLonBox == nil && o.LatLonQuad != nil {
+			return fmt.Errorf("GroundOverlay %q is placed with a gx:LatLonQuad, which is not supported", o.Name)
+		}
+		b, err := o.box()
+		if err != nil {
+			return err
+		}
+		img := filepath.Join(srcDir, fmt.Sprintf("%03d.jpg", i))
+		if err = extractOverlayJpg(img, open, o.Icon.Href); err != nil {
+			return fmt.Errorf("GroundOverlay %q: %v", o.Name, err)
+		}
+		w, h, err := ib.Identify(img)
+		if err != nil {
+			return err
+		}
+		sizes[i] = image.Pt(w, h)
+		jobs[i] = &tileJob{
+			image:          img,
+			width:          w,
+			height:         h,
+			base:           fmt.Sprintf("%s-%03d", base, i),
+			box:            b[:],
+			rotation:       o.LatLonBox.Rotation,
+			dev:            dev,
+			skipBlank:      skipBlank,
+			blankTolerance: blankTolerance,
+		}
+		if o.DrawOrder < minOrder {
+			minOrder = o.DrawOrder
+		}
+	}
+	budget, err := tileBudget(sizes, nil, dev.maxTiles, dev.maxTilePixels)
+	if err != nil {
+		return err
+	}
+
+	kmzDir := filepath.Join(tmpDir, base)
+	tilesDir := filepath.Join(kmzDir, "tiles")
+	if err = os.MkdirAll(tilesDir, 0755); err != nil {
+		return fmt.Errorf("Error making tiles dir in tmp dir: %v", err)
+	}
+	for i, tj := range jobs {
+		tj.maxPixels = budget[i]
+		tj.drawingOrder = dev.drawingOrder + overlays[i].DrawOrder - minOrder
+		tj.tmpDir, tj.kmzDir, tj.tilesDir = tmpDir, kmzDir, tilesDir
+	}
+	tiles, err := chopAll(ib, jobs, dev.maxTiles)
+	if err != nil {
+		return err
+	}
+	doc := &kmlDocument{Name: base}
+	for _, t := range tiles {
+		doc.Overlays = append(doc.Overlays, t...)
+	}
+	return writeKMZ(out, kmzDir, doc)
+}
+
+// extractOverlayJpg writes the overlay image at href to outFile. Non
+// JPEG images, which may have transparency, are drawn onto white and
+// written as JPEG.
+func extractOverlayJpg(outFile string, open func(href string) (io.ReadCloser, error), href string) error {
+	r, err := open(href)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	_, format, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Error reading image %v: %v", href, err)
+	}
+	if format == "jpeg" {
+		return nil
+	}
+	glog.Infof("Flattening %v image %v onto white\n", format, href)
+	src, err := decodeImage(outFile)
+	if err != nil {
+		return err
+	}
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Over)
+	return writeJpg(outFile, dst, jpegQuality)
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// writeTestKMZ writes a KMZ of the given files by their path in it
+func writeTestKMZ(t *testing.T, fpath string, files map[string][]byte) {
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z := zip.NewWriter(f)
+	for name, b := range files {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testJpg returns a width x height JPEG of a single colour
+func testJpg(t *testing.T, width, height int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestConvertTwoKMLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// doc.kml links to sub/more.kml, whose image href is relative to it
+	kmz := filepath.Join(dir, "two.kmz")
+	writeTestKMZ(t, kmz, map[string][]byte{
+		"doc.kml": []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document>
+<GroundOverlay><name>a</name><Icon><href>a.jpg</href></Icon>
+<LatLonBox><north>50</north><south>49</south><east>-122</east><west>-123</west></LatLonBox></GroundOverlay>
+<NetworkLink><Link><href>sub/more.kml</href></Link></NetworkLink>
+</Document></kml>`),
+		"sub/more.kml": []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document>
+<GroundOverlay><name>b</name><Icon><href>b.jpg</href></Icon>
+<LatLonBox><north>51</north><south>50</south><east>-122</east><west>-123</west></LatLonBox></GroundOverlay>
+</Document></kml>`),
+		"a.jpg":     testJpg(t, 300, 200, color.White),
+		"sub/b.jpg": testJpg(t, 300, 200, color.White),
+	})
+
+	overlays, err := readKMZOverlays(kmz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlays) != 2 || overlays[0].Icon.Href != "a.jpg" || overlays[1].Icon.Href != "sub/b.jpg" {
+		t.Fatalf("got %d overlays", len(overlays))
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.Set("backend", goBackend)
+	v.Set("device", defaultDevice)
+	v.Set("name", "out")
+	if err = processConvert(v, []string{kmz}); err != nil {
+		t.Fatal(err)
+	}
+	if overlays, err = readKMZOverlays(filepath.Join(dir, "out.kmz")); err != nil {
+		t.Fatal(err)
+	}
+	box, err := overlaysBox(overlays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{51, 49, -122, -123}; !boxNear(box, want, 1e-9) {
+		t.Errorf("converted overlays cover %v, want %v", box, want)
+	}
+}
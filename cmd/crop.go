@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+// mapCrop is the part of a map to keep, cutting off its collar of
+// legends and margins outside the neat line. Either a pixel rectangle
+// of the input image or a lat/long box, or neither.
+type mapCrop struct {
+	pixels image.Rectangle // in the input image, if not empty
+	box    []float64       // north, south, east, west, if not nil
+}
+
+// cropFlags returns the crop given by the "crop_pixels" or "crop_box"
+// viper keys, if any. Crops only make sense for a single north-up
+// image.
+func cropFlags(v *viper.Viper, rotation float64, hasQuad bool, args []string) (mc mapCrop, err error) {
+	pixels, box := v.GetString("crop_pixels"), v.GetString("crop_box")
+	if pixels == "" && box == "" {
+		return mc, nil
+	}
+	if pixels != "" && box != "" {
+		return mc, fmt.Errorf("Give either a pixel or lat/long crop, not both")
+	}
+	if len(args) != 1 {
+		return mc, fmt.Errorf("Crops can only be given for one image at a time")
+	}
+	if rotation != 0 || hasQuad {
+		return mc, fmt.Errorf("Crops are not supported for maps placed with a rotation or corners")
+	}
+	if pixels != "" {
+		mc.pixels, err = parsePixelRect(pixels)
+	} else {
+		mc.box, err = parseCropBox(box)
+	}
+	return mc, err
+}
+
+// parseFloats parses n comma separated numbers
+func parseFloats(s string, n int) ([]float64, error) {
+	c := strings.Split(s, ",")
+	if len(c) != n {
+		return nil, fmt.Errorf("Expected %d comma separated numbers, got %q", n, s)
+	}
+	var f []float64
+	for _, v := range c {
+		x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, x)
+	}
+	return f, nil
+}
+
+// parsePixelRect parses the left,top,right,bottom pixel rectangle of
+// --crop_pixels, measured from the image's top left corner
+func parsePixelRect(s string) (image.Rectangle, error) {
+	f, err := parseFloats(s, 4)
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("Error parsing pixel crop left,top,right,bottom: %v", err)
+	}
+	for _, x := range f {
+		if x != math.Trunc(x) || x < 0 {
+			return image.Rectangle{}, fmt.Errorf("Pixel crop must be whole, non-negative pixels, got %q", s)
+		}
+	}
+	if f[0] >= f[2] || f[1] >= f[3] {
+		return image.Rectangle{}, fmt.Errorf("Pixel crop right must be greater than left and bottom greater than top, got %q", s)
+	}
+	return image.Rect(int(f[0]), int(f[1]), int(f[2]), int(f[3])), nil
+}
+
+// parseCropBox parses the north,south,east,west decimal degrees of
+// --crop_box
+func parseCropBox(s string) ([]float64, error) {
+	box, err := parseBox(s)
+	if err != nil {
+		return nil, fmt.Errorf("Error with crop box: %v", err)
+	}
+	box[east], box[west] = normEasting(box[east]), normEasting(box[west])
+	return box, nil
+}
+
+// boxWidth returns how far east the box's east edge is of its west,
+// in degrees if latLong otherwise projected CRS units
+func boxWidth(box []float64, latLong bool) float64 {
+	if latLong {
+		return eastDelta(box[east], box[west])
+	}
+	return box[east] - box[west]
+}
+
+// subBox returns the bounding box of the pixel rectangle r of a
+// width x height image covering box. The box is in lat/long if
+// latLong, otherwise in projected CRS units.
+func subBox(box []float64, r image.Rectangle, width, height int, latLong bool) []float64 {
+	ns := box[north] - box[south]
+	ew := boxWidth(box, latLong)
+	sb := []float64{
+		box[north] - ns*float64(r.Min.Y)/float64(height),
+		box[north] - ns*float64(r.Max.Y)/float64(height),
+		box[west] + ew*float64(r.Max.X)/float64(width),
+		box[west] + ew*float64(r.Min.X)/float64(width),
+	}
+	if latLong {
+		sb[east], sb[west] = normEasting(sb[east]), normEasting(sb[west])
+	}
+	return sb
+}
+
+// boxPixelRect returns the pixel rectangle of a width x height image
+// covering lat/long box that best matches the lat/long sub box,
+// clipped to the image. Empty if they do not overlap.
+func boxPixelRect(box, sub []float64, width, height int) image.Rectangle {
+	ns := box[north] - box[south]
+	ew := eastDelta(box[east], box[west])
+	x0 := eastDelta(sub[west], box[west])
+	if x0 > ew {
+		x0 -= 360 // sub's west edge is west of the box
+	}
+	x1 := x0 + eastDelta(sub[east], sub[west])
+	r := image.Rect(
+		int(math.Round(x0/ew*float64(width))),
+		int(math.Round((box[north]-sub[north])/ns*float64(height))),
+		int(math.Round(x1/ew*float64(width))),
+		int(math.Round((box[north]-sub[south])/ns*float64(height))),
+	)
+	return r.Intersect(image.Rect(0, 0, width, height))
+}
+
+// cropPixels cuts the given map image down to mc's pixel rectangle,
+// if any, returning the cropped image written in tmpDir and its box.
+// The box is in projected CRS units if latLong is false.
+func (mc mapCrop) cropPixels(ib ImageBackend, tmpDir, img string, box []float64, latLong bool) (string, []float64, error) {
+	if mc.pixels.Empty() {
+		return img, box, nil
+	}
+	return cropMap(ib, filepath.Join(tmpDir, "cropped.jpg"), img, box, mc.pixels, latLong)
+}
+
+// cropBox cuts the given lat/long map image down to mc's lat/long
+// box, if any, returning the cropped image written in tmpDir and its
+// box. The box is that of the whole pixels kept, so may differ a
+// little from mc's.
+func (mc mapCrop) cropBox(ib ImageBackend, tmpDir, img string, box []float64) (string, []float64, error) {
+	if mc.box == nil {
+		return img, box, nil
+	}
+	w, h, err := ib.Identify(img)
+	if err != nil {
+		return "", nil, err
+	}
+	r := boxPixelRect(box, mc.box, w, h)
+	if r.Empty() {
+		return "", nil, fmt.Errorf("Crop box %v is not within the map's %v", mc.box, box)
+	}
+	return cropMap(ib, filepath.Join(tmpDir, "cropped.jpg"), img, box, r, true)
+}
+
+// cropMap writes the pixel rectangle r of inFile, covering box, to
+// outFile as a JPG and returns outFile and its box.
+func cropMap(ib ImageBackend, outFile, inFile string, box []float64, r image.Rectangle, latLong bool) (string, []float64, error) {
+	w, h, err := ib.Identify(inFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if !r.In(image.Rect(0, 0, w, h)) {
+		return "", nil, fmt.Errorf("Crop %v is not within the %dx%d image", r, w, h)
+	}
+	cbox := subBox(box, r, w, h, latLong)
+	glog.Infof("Cropping %v to %v, box %v to %v\n", inFile, r, box, cbox)
+	if err = ib.Extract(outFile, inFile, r); err != nil {
+		return "", nil, err
+	}
+	return outFile, cbox, nil
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePixelRect(t *testing.T) {
+	r, err := parsePixelRect("10, 20,110,220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != image.Rect(10, 20, 110, 220) {
+		t.Errorf("got %v", r)
+	}
+	for _, s := range []string{"", "1,2,3", "10,20,5,30", "10,20,30,20", "-1,0,10,10", "0.5,0,10,10", "a,b,c,d"} {
+		if _, err := parsePixelRect(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestParseCropBox(t *testing.T) {
+	box, err := parseCropBox("49.9, 49.5,-122.1,190")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{49.9, 49.5, -122.1, -170}; !boxNear(box, want, 1e-9) {
+		t.Errorf("got %v, want %v", box, want)
+	}
+	for _, s := range []string{"", "50,49,-122", "49,50,-122,-123", "a,49,-122,-123"} {
+		if _, err := parseCropBox(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestSubBox(t *testing.T) {
+	tests := []struct {
+		box     []float64
+		r       image.Rectangle
+		latLong bool
+		want    []float64
+	}{
+		{[]float64{50, 40, 10, 0}, image.Rect(0, 0, 100, 100), true, []float64{50, 40, 10, 0}},
+		{[]float64{50, 40, 10, 0}, image.Rect(25, 50, 75, 100), true, []float64{45, 40, 7.5, 2.5}},
+		{[]float64{50, 40, -170, 170}, image.Rect(50, 0, 100, 100), true, []float64{50, 40, -170, 180}},
+		{[]float64{5500000, 5400000, 600000, 500000}, image.Rect(10, 10, 90, 90), false, []float64{5490000, 5410000, 590000, 510000}},
+	}
+	for _, tt := range tests {
+		got := subBox(tt.box, tt.r, 100, 100, tt.latLong)
+		for i := range got {
+			if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+				t.Errorf("%v %v: got %v, want %v", tt.box, tt.r, got, tt.want)
+				break
+			}
+		}
+		if !tt.latLong {
+			continue
+		}
+		// and back again
+		if r := boxPixelRect(tt.box, got, 100, 100); r != tt.r {
+			t.Errorf("%v %v: box %v back to %v", tt.box, tt.r, got, r)
+		}
+	}
+
+	// clipped to the image, or empty if outside it
+	if r := boxPixelRect([]float64{50, 40, 10, 0}, []float64{55, 45, 5, -5}, 100, 100); r != image.Rect(0, 0, 50, 50) {
+		t.Errorf("got %v, want clipped to top left quarter", r)
+	}
+	if r := boxPixelRect([]float64{50, 40, 10, 0}, []float64{30, 20, 5, -5}, 100, 100); !r.Empty() {
+		t.Errorf("got %v, want empty", r)
+	}
+}
+
+func TestCropBox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "map.jpg")
+	if err = writeJpg(src, image.NewGray(image.Rect(0, 0, 400, 200)), jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+
+	mc := mapCrop{box: []float64{49.9, 49.5, -122.1, -122.9}}
+	out, box, err := mc.cropBox(goImager{}, dir, src, []float64{50, 49, -122, -123})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h, err := goImager{}.Identify(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != 320 || h != 80 {
+		t.Errorf("cropped to %dx%d, want 320x80", w, h)
+	}
+	for i := range box {
+		if math.Abs(box[i]-mc.box[i]) > 1e-9 {
+			t.Errorf("cropped box %v, want %v", box, mc.box)
+			break
+		}
+	}
+
+	mc = mapCrop{pixels: image.Rect(300, 100, 500, 200)}
+	if _, _, err = mc.cropPixels(goImager{}, dir, src, []float64{50, 49, -122, -123}, true); err == nil {
+		t.Errorf("expected error cropping outside the image")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir, src, _ := writeTestMap(t, 400, 200)
+	defer os.RemoveAll(dir)
+
+	// every backend installed cuts the same rectangle, all of it SE
+	r := image.Rect(250, 120, 350, 180)
+	for _, name := range []string{magickBackend, gmBackend, vipsBackend, goBackend} {
+		ib, err := newImageBackend(name)
+		if err != nil {
+			continue
+		}
+		out := filepath.Join(dir, name+".jpg")
+		if err = ib.Extract(out, src, r); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		img, err := decodeImage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != r.Dx() || b.Dy() != r.Dy() {
+			t.Errorf("%v cut %v, want %v", name, b, r)
+		}
+		checkColor(t, name, img, image.Pt(0, 0), se)
+		checkColor(t, name, img, image.Pt(r.Dx()-1, r.Dy()-1), se)
+	}
+}
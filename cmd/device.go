@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// megaPixel is the 1MP Garmins treat as the max useful tile size
+const megaPixel = tileSide * tileSide
+
+// garminMinDrawOrder is the lowest drawOrder Garmins show
+const garminMinDrawOrder = 51
+
+// garminMaxTileBytes is the largest tile JPG Garmins load
+const garminMaxTileBytes = 3 * 1024 * 1024
+
+// defaultDevice is the profile used when no --device is given
+const defaultDevice = "garmin"
+
+// device is a GPS model's limits on KMZ custom maps
+type device struct {
+	name          string
+	maxTiles      int   // across all custom maps loaded
+	maxTilePixels int   // w x h, more add no clarity
+	maxTileBytes  int64 // of each tile's JPG
+	drawingOrder  int   // default GroundOverlay drawOrder
+}
+
+// deviceMaxTiles are the built-in profiles selectable with --device,
+// by their max tiles. The Garmins differ only in how many tiles they
+// load; all take tiles of up to megaPixel pixels and
+// garminMaxTileBytes, drawn from garminMinDrawOrder up. Other limits,
+// or other devices, can be given in the config file, e.g.
+//
+//   devices:
+//     mygps:
+//       max_tiles: 300
+//       max_tile_pixels: 1048576
+//       max_tile_bytes: 3145728
+//       drawing_order: 60
+var deviceMaxTiles = map[string]int{
+	defaultDevice: 100,
+	"etrex":       100,
+	"gpsmap62":    100,
+	"gpsmap64":    500,
+	"gpsmap66":    500,
+	"montana":     500,
+	"oregon600":   500,
+	"oregon700":   500,
+}
+
+// deviceNames returns the built-in device profile names, sorted
+func deviceNames() string {
+	var names []string
+	for n := range deviceMaxTiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// lookupDevice returns the named device profile from the config
+// file's "devices" or the built-in ones. Limits a profile does not
+// give are the default device's.
+func lookupDevice(v *viper.Viper, name string) (*device, error) {
+	if name == "" {
+		name = defaultDevice
+	}
+	name = strings.ToLower(name)
+	maxTiles, builtIn := deviceMaxTiles[name]
+	d := device{maxTiles: maxTiles}
+	key := "devices." + name
+	if !builtIn && !v.IsSet(key) {
+		return nil, fmt.Errorf("Unknown device %q, must be one of %v or in the config file's devices", name, deviceNames())
+	}
+	if v.IsSet(key + ".max_tiles") {
+		d.maxTiles = v.GetInt(key + ".max_tiles")
+	}
+	if v.IsSet(key + ".max_tile_pixels") {
+		d.maxTilePixels = v.GetInt(key + ".max_tile_pixels")
+	}
+	if v.IsSet(key + ".max_tile_bytes") {
+		d.maxTileBytes = v.GetInt64(key + ".max_tile_bytes")
+	}
+	if v.IsSet(key + ".drawing_order") {
+		d.drawingOrder = v.GetInt(key + ".drawing_order")
+	}
+	d.name = name
+	if d.maxTiles == 0 {
+		d.maxTiles = deviceMaxTiles[defaultDevice]
+	}
+	if d.maxTilePixels == 0 {
+		d.maxTilePixels = megaPixel
+	}
+	if d.maxTileBytes == 0 {
+		d.maxTileBytes = garminMaxTileBytes
+	}
+	if d.drawingOrder == 0 {
+		d.drawingOrder = garminMinDrawOrder
+	}
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// deviceFromFlags returns the device profile named by "device" in
+// viper, with its max tiles and drawing order replaced by "max_tiles"
+// and "drawing_order" if they are not 0.
+func deviceFromFlags(v *viper.Viper) (*device, error) {
+	d, err := lookupDevice(v, v.GetString("device"))
+	if err != nil {
+		return nil, err
+	}
+	if n := v.GetInt("max_tiles"); n != 0 {
+		d.maxTiles = n
+	}
+	if n := v.GetInt("drawing_order"); n != 0 {
+		d.drawingOrder = n
+	}
+	if err = d.check(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// check returns an error if any of d's limits are not positive
+func (d *device) check() error {
+	if d.maxTiles < 0 || d.maxTilePixels < 1 || d.maxTileBytes < 0 || d.drawingOrder < 0 {
+		return fmt.Errorf("Device %v limits must be positive", d.name)
+	}
+	return nil
+}
+
+func (d *device) String() string {
+	return fmt.Sprintf("%v (max %d tiles of %d pixels & %d bytes, drawOrder %d)", d.name, d.maxTiles, d.maxTilePixels, d.maxTileBytes, d.drawingOrder)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLookupDevice(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+devices:
+  mygps:
+    max_tiles: 300
+    max_tile_pixels: 262144
+  montana:
+    drawing_order: 60
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		maxTiles      int
+		maxTilePixels int
+		drawingOrder  int
+	}{
+		{"", 100, megaPixel, garminMinDrawOrder},
+		{"gpsmap62", 100, megaPixel, garminMinDrawOrder},
+		{"Oregon600", 500, megaPixel, garminMinDrawOrder},
+		{"montana", 500, megaPixel, 60},
+		{"mygps", 300, 262144, garminMinDrawOrder},
+	}
+	for _, tt := range tests {
+		d, err := lookupDevice(v, tt.name)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.name, err)
+			continue
+		}
+		if d.maxTiles != tt.maxTiles || d.maxTilePixels != tt.maxTilePixels || d.drawingOrder != tt.drawingOrder || d.maxTileBytes != garminMaxTileBytes {
+			t.Errorf("%q: got %v", tt.name, d)
+		}
+	}
+	if _, err = lookupDevice(v, "nokia"); err == nil {
+		t.Errorf("expected error for unknown device")
+	}
+}
+
+func TestDeviceFromFlags(t *testing.T) {
+	v := viper.New()
+	v.Set("device", "montana")
+	v.Set("max_tiles", 300)
+	v.Set("drawing_order", 70)
+	d, err := deviceFromFlags(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.maxTiles != 300 || d.drawingOrder != 70 {
+		t.Errorf("got %v", d)
+	}
+	v.Set("max_tiles", -5)
+	if _, err = deviceFromFlags(v); err == nil {
+		t.Errorf("expected error for negative max_tiles")
+	}
+	v.Set("max_tiles", 0)
+	v.Set("drawing_order", -1)
+	if _, err = deviceFromFlags(v); err == nil {
+		t.Errorf("expected error for negative drawing_order")
+	}
+}
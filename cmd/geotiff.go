@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// TIFF & GeoTIFF tags and GeoKeys we use
+const (
+	tagImageWidth        = 256
+	tagImageLength       = 257
+	tagModelPixelScale   = 33550
+	tagModelTiepoint     = 33922
+	tagGeoKeyDirectory   = 34735
+	keyModelType         = 1024 // 1 projected, 2 geographic
+	keyRasterType        = 1025 // 1 pixel is area, 2 pixel is point
+	keyGeographicType    = 2048 // EPSG code of geographic CRS
+	keyProjectedCSType   = 3072 // EPSG code of projected CRS
+	modelTypeProjected   = 1
+	modelTypeGeographic  = 2
+	rasterPixelIsPoint   = 2
+	geoKeyUserDefined    = 32767
+	tiffTypeShort        = 3
+	tiffTypeLong         = 4
+	tiffTypeDouble       = 12
+	tiffClassicMagic     = 42
+	tiffIFDEntryByteSize = 12
+	tiffMaxTagBytes      = 16 << 20 // more than any georeferencing needs
+)
+
+// geoTIFF holds the georeferencing read from a GeoTIFF's tags
+type geoTIFF struct {
+	width, height int
+	tiepoint      [6]float64 // raster I, J, K to model X, Y, Z
+	scale         [3]float64 // model units per pixel in X, Y, Z
+	pixelIsPoint  bool       // tiepoint is a pixel centre, not corner
+	geographic    bool       // model X, Y are long, lat
+	crs           int        // EPSG code, 0 if unknown or user defined
+}
+
+// readGeoTIFF reads the georeferencing tags of the given TIFF
+// file's first image. Returns an error if it is not a TIFF or lacks
+// the ModelTiepoint & ModelPixelScale tags.
+func readGeoTIFF(fpath string) (*geoTIFF, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tags, err := readTIFFTags(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading TIFF tags of %v: %v", fpath, err)
+	}
+	gt := &geoTIFF{}
+	if len(tags[tagImageWidth]) != 1 || len(tags[tagImageLength]) != 1 {
+		return nil, fmt.Errorf("TIFF %v has no image width & height", fpath)
+	}
+	gt.width, gt.height = int(tags[tagImageWidth][0]), int(tags[tagImageLength][0])
+	tp, ps := tags[tagModelTiepoint], tags[tagModelPixelScale]
+	if len(tp) < 6 || len(ps) < 3 {
+		return nil, fmt.Errorf("TIFF %v is not geo-referenced: needs ModelTiepoint and ModelPixelScale tags", fpath)
+	}
+	copy(gt.tiepoint[:], tp)
+	copy(gt.scale[:], ps)
+
+	keys := geoKeys(tags[tagGeoKeyDirectory])
+	gt.pixelIsPoint = keys[keyRasterType] == rasterPixelIsPoint
+	switch keys[keyModelType] {
+	case modelTypeProjected:
+		gt.crs = keys[keyProjectedCSType]
+	case modelTypeGeographic:
+		gt.geographic = true
+		gt.crs = keys[keyGeographicType]
+	default:
+		return nil, fmt.Errorf("TIFF %v has unknown GeoTIFF model type %v", fpath, keys[keyModelType])
+	}
+	if gt.crs == geoKeyUserDefined {
+		gt.crs = 0
+	}
+	return gt, nil
+}
+
+// box returns the GeoTIFF's bounding box in model units in north,
+// south, east, west order. For geographic GeoTIFFs that is decimal
+// degrees.
+func (gt *geoTIFF) box() []float64 {
+	i, j := gt.tiepoint[0], gt.tiepoint[1]
+	if gt.pixelIsPoint {
+		// tiepoint is a pixel centre, move it out to the corner
+		i, j = i+0.5, j+0.5
+	}
+	box := make([]float64, 4)
+	box[west] = gt.tiepoint[3] - i*gt.scale[0]
+	box[north] = gt.tiepoint[4] + j*gt.scale[1]
+	box[east] = box[west] + float64(gt.width)*gt.scale[0]
+	box[south] = box[north] - float64(gt.height)*gt.scale[1]
+	return box
+}
+
+// geoKeys returns the short valued keys from the given
+// GeoKeyDirectory tag values. Keys whose values are stored in other
+// tags are skipped as we do not need them.
+func geoKeys(dir []float64) map[int]int {
+	keys := make(map[int]int)
+	if len(dir) < 4 {
+		return keys
+	}
+	n := int(dir[3])
+	for k := 1; k <= n && 4*k+3 < len(dir); k++ {
+		id, loc, val := dir[4*k], dir[4*k+1], dir[4*k+3]
+		if loc == 0 {
+			keys[int(id)] = int(val)
+		}
+	}
+	return keys
+}
+
+// readTIFFTags returns the numeric SHORT, LONG and DOUBLE valued tags
+// of a classic (not Big) TIFF's first IFD, all as float64s. Tags with
+// more values than the file or tiffMaxTagBytes could hold are an error.
+func readTIFFTags(r io.ReadSeeker) (map[int][]float64, error) {
+	fileSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	var bo binary.ByteOrder
+	switch string(hdr[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Not a TIFF file")
+	}
+	if bo.Uint16(hdr[2:]) != tiffClassicMagic {
+		return nil, fmt.Errorf("Only classic TIFF is supported, not BigTIFF")
+	}
+	if _, err := r.Seek(int64(bo.Uint32(hdr[4:])), io.SeekStart); err != nil {
+		return nil, err
+	}
+	var n uint16
+	if err := binary.Read(r, bo, &n); err != nil {
+		return nil, err
+	}
+	entries := make([]byte, int(n)*tiffIFDEntryByteSize)
+	if _, err := io.ReadFull(r, entries); err != nil {
+		return nil, err
+	}
+	tags := make(map[int][]float64)
+	for e := entries; len(e) >= tiffIFDEntryByteSize; e = e[tiffIFDEntryByteSize:] {
+		tag, typ, count := int(bo.Uint16(e)), bo.Uint16(e[2:]), uint64(bo.Uint32(e[4:]))
+		var size uint64
+		switch typ {
+		case tiffTypeShort:
+			size = 2
+		case tiffTypeLong:
+			size = 4
+		case tiffTypeDouble:
+			size = 8
+		default:
+			continue
+		}
+		if n := size * count; n > uint64(fileSize) || n > tiffMaxTagBytes {
+			return nil, fmt.Errorf("TIFF tag %d has %d values, more than the file holds", tag, count)
+		}
+		data := e[8:12]
+		if size*count > 4 {
+			data = make([]byte, size*count)
+			if _, err := r.Seek(int64(bo.Uint32(e[8:])), io.SeekStart); err != nil {
+				return nil, err
+			}
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, fmt.Errorf("Error reading tag %d values: %v", tag, err)
+			}
+		}
+		vals := make([]float64, count)
+		for i := range vals {
+			switch typ {
+			case tiffTypeShort:
+				vals[i] = float64(bo.Uint16(data[2*i:]))
+			case tiffTypeLong:
+				vals[i] = float64(bo.Uint32(data[4*i:]))
+			case tiffTypeDouble:
+				vals[i] = math.Float64frombits(bo.Uint64(data[8*i:]))
+			}
+		}
+		tags[tag] = vals
+	}
+	return tags, nil
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testTIFFTag is a SHORT or DOUBLE valued tag for writeTestTIFF
+type testTIFFTag struct {
+	tag     uint16
+	shorts  []uint16
+	doubles []float64
+}
+
+// writeTestTIFF writes a little endian TIFF with just an IFD holding
+// the given tags, which is all readTIFFTags looks at.
+func writeTestTIFF(t *testing.T, fpath string, tags []testTIFFTag) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i].tag < tags[j].tag })
+	var ifd, vals bytes.Buffer
+	le := binary.LittleEndian
+	valsOff := uint32(8 + 2 + len(tags)*tiffIFDEntryByteSize + 4)
+	binary.Write(&ifd, le, uint16(len(tags)))
+	for _, tt := range tags {
+		binary.Write(&ifd, le, tt.tag)
+		if tt.doubles != nil {
+			binary.Write(&ifd, le, uint16(tiffTypeDouble))
+			binary.Write(&ifd, le, uint32(len(tt.doubles)))
+			binary.Write(&ifd, le, valsOff+uint32(vals.Len()))
+			binary.Write(&vals, le, tt.doubles)
+			continue
+		}
+		binary.Write(&ifd, le, uint16(tiffTypeShort))
+		binary.Write(&ifd, le, uint32(len(tt.shorts)))
+		if len(tt.shorts) <= 2 {
+			v := append(tt.shorts, 0, 0)[:2]
+			binary.Write(&ifd, le, v)
+			continue
+		}
+		binary.Write(&ifd, le, valsOff+uint32(vals.Len()))
+		binary.Write(&vals, le, tt.shorts)
+	}
+	binary.Write(&ifd, le, uint32(0)) // no next IFD
+	b := append([]byte{'I', 'I', 42, 0, 8, 0, 0, 0}, ifd.Bytes()...)
+	if err := ioutil.WriteFile(fpath, append(b, vals.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoTIFF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "survey.tif")
+	writeTestTIFF(t, fpath, []testTIFFTag{
+		{tag: tagImageWidth, shorts: []uint16{150}},
+		{tag: tagImageLength, shorts: []uint16{280}},
+		{tag: tagModelTiepoint, doubles: []float64{0, 0, 0, -123.131, 49.4705, 0}},
+		{tag: tagModelPixelScale, doubles: []float64{0.001, 0.0005, 0}},
+		{tag: tagGeoKeyDirectory, shorts: []uint16{
+			1, 1, 0, 3,
+			keyModelType, 0, 1, modelTypeGeographic,
+			keyRasterType, 0, 1, 1,
+			keyGeographicType, 0, 1, 4326,
+		}},
+	})
+	gt, err := readGeoTIFF(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gt.geographic || gt.crs != 4326 || gt.pixelIsPoint {
+		t.Errorf("Wrong GeoKeys: %+v", gt)
+	}
+	box := gt.box()
+	want := [4]float64{49.4705, 49.3305, -122.981, -123.131}
+	for i := range want {
+		if math.Abs(box[i]-want[i]) > 1e-9 {
+			t.Errorf("Wrong box edge %d: %v, want %v", i, box[i], want[i])
+		}
+	}
+
+	notGeo := filepath.Join(dir, "plain.tif")
+	writeTestTIFF(t, notGeo, []testTIFFTag{
+		{tag: tagImageWidth, shorts: []uint16{150}},
+		{tag: tagImageLength, shorts: []uint16{280}},
+	})
+	if _, err = readGeoTIFF(notGeo); err == nil {
+		t.Errorf("Expected error for TIFF without geo tags")
+	}
+
+	// tag value counts too big for the file, as if truncated or hostile
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, count := range []uint32{100, 0xfffffff0} {
+		binary.LittleEndian.PutUint32(b[8+2+2*tiffIFDEntryByteSize+4:], count) // ModelPixelScale
+		bad := filepath.Join(dir, "bad.tif")
+		if err = ioutil.WriteFile(bad, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readGeoTIFF(bad); err == nil {
+			t.Errorf("Expected error for a tag of %d values", count)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/golang/glog"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+)
+
+// goImager is an ImageBackend using go's image packages, so no
+// external programs are required. Whole images are decoded into
+// memory so it is slower and hungrier than the others for very large
+// images.
+type goImager struct{}
+
+func (goImager) String() string { return goBackend }
+
+// Identify reads only the image header.
+func (goImager) Identify(imageFilename string) (width int, height int, err error) {
+	f, err := os.Open(imageFilename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error reading image header of %v: %v", imageFilename, err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// decodeImage reads and decodes the given image file. Any format with
+// a registered decoder (jpg, png, gif, tiff, bmp) is accepted.
+func decodeImage(imageFilename string) (image.Image, error) {
+	f, err := os.Open(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding image %v: %v", imageFilename, err)
+	}
+	return img, nil
+}
+
+// writeJpg encodes img as a baseline (non-progressive) JPG without
+// any metadata, which is what Garmins want.
+func writeJpg(outFile string, img image.Image, quality int) error {
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	if err = jpeg.Encode(f, img, &jpeg.Options{Quality: quality}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// minJpegQuality is the lowest quality fitJpg will go to
+const minJpegQuality = 10
+
+// fitJpg re-encodes the JPG at fpath with the highest quality below
+// jpegQuality that makes it maxBytes or smaller, returning the quality
+// and new size.
+func fitJpg(fpath string, maxBytes int64) (quality int, size int64, err error) {
+	img, err := decodeImage(fpath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var best []byte
+	lo, hi := minJpegQuality, jpegQuality-1
+	for lo <= hi { // binary search as size grows with quality
+		q := (lo + hi) / 2
+		var b bytes.Buffer
+		if err = jpeg.Encode(&b, img, &jpeg.Options{Quality: q}); err != nil {
+			return 0, 0, err
+		}
+		if int64(b.Len()) <= maxBytes {
+			quality, best = q, b.Bytes()
+			lo = q + 1
+		} else {
+			hi = q - 1
+		}
+	}
+	if best == nil {
+		return 0, 0, fmt.Errorf("Still over %d bytes at JPEG quality %d", maxBytes, minJpegQuality)
+	}
+	glog.Infof("Re-encoded %v at quality %d to %d bytes\n", fpath, quality, len(best))
+	return quality, int64(len(best)), ioutil.WriteFile(fpath, best, 0644)
+}
+
+func (goImager) Resize(outFile, inFile string, maxPixArea int) error {
+	glog.Infof("Resizing %v to %v pixel area in %v\n", inFile, maxPixArea, outFile)
+	src, err := decodeImage(inFile)
+	if err != nil {
+		return err
+	}
+	sb := src.Bounds()
+	scale := math.Sqrt(float64(maxPixArea) / float64(sb.Dx()*sb.Dy()))
+	w := int(math.Max(1, math.Floor(float64(sb.Dx())*scale)))
+	h := int(math.Max(1, math.Floor(float64(sb.Dy())*scale)))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, sb, draw.Src, nil)
+	return writeJpg(outFile, dst, jpegQuality)
+}
+
+func (goImager) Normalize(outFile, inFile string) error {
+	glog.Infof("Re-encoding %v as %v\n", inFile, outFile)
+	src, err := decodeImage(inFile)
+	if err != nil {
+		return err
+	}
+	return writeJpg(outFile, src, jpegQuality)
+}
+
+func (goImager) Crop(fixedJpg, outDir, baseName string, tl tileLayout) error {
+	glog.Infof("Chopping %v into tiles in %v\n", fixedJpg, outDir)
+	src, err := decodeImage(fixedJpg)
+	if err != nil {
+		return err
+	}
+	sub, ok := src.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return fmt.Errorf("Cannot crop image of type %T", src)
+	}
+	for i := 0; i < tl.tiles(); i++ {
+		r := tl.tileRect(i, src.Bounds())
+		if err = writeJpg(tileFile(outDir, baseName, i), sub.SubImage(r), jpegQuality); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (goImager) Extract(outFile, inFile string, r image.Rectangle) error {
+	glog.Infof("Cutting %v out of %v into %v\n", r, inFile, outFile)
+	src, err := decodeImage(inFile)
+	if err != nil {
+		return err
+	}
+	sub, ok := src.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return fmt.Errorf("Cannot crop image of type %T", src)
+	}
+	return writeJpg(outFile, sub.SubImage(r.Add(src.Bounds().Min)), jpegQuality)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFitJpg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// noise compresses badly so quality matters
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.RGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255})
+		}
+	}
+	fpath := filepath.Join(dir, "tile.jpg")
+	if err = writeJpg(fpath, img, jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxBytes := fi.Size() / 2
+	q, size, err := fitJpg(fpath, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(fpath); err != nil {
+		t.Fatal(err)
+	}
+	if size > maxBytes || fi.Size() != size {
+		t.Errorf("got %d bytes (file %d), want <= %d", size, fi.Size(), maxBytes)
+	}
+	if q < minJpegQuality || q >= jpegQuality {
+		t.Errorf("quality %d out of range", q)
+	}
+	if _, _, err = fitJpg(fpath, 100); err == nil {
+		t.Errorf("expected error fitting into 100 bytes")
+	}
+}
+
+func TestGoImagerCrop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "map.jpg")
+	if err = writeJpg(src, image.NewGray(image.Rect(0, 0, 2500, 1300)), jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+
+	// the right column & bottom row are short
+	tl := tileLayout{cols: 3, rows: 2, width: 1000, height: 1000}
+	if err = (goImager{}).Crop(src, dir, "map", tl); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []image.Point{{1000, 1000}, {1000, 1000}, {500, 1000}, {1000, 300}, {1000, 300}, {500, 300}} {
+		w, h, err := goImager{}.Identify(tileFile(dir, "map", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != want.X || h != want.Y {
+			t.Errorf("tile %d is %dx%d, want %v", i, w, h, want)
+		}
+	}
+	if _, err = os.Stat(tileFile(dir, "map", tl.tiles())); err == nil {
+		t.Errorf("more tiles than the %dx%d layout", tl.cols, tl.rows)
+	}
+}
+
+func TestGoImagerResize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "map.png")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(f, image.NewGray(image.Rect(0, 0, 2000, 1000))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	out := filepath.Join(dir, "small.jpg")
+	if err = (goImager{}).Resize(out, src, 200000); err != nil {
+		t.Fatal(err)
+	}
+	w, h, err := goImager{}.Identify(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w*h > 200000 || w*h < 199000 || math.Abs(float64(w)/float64(h)-2) > 0.01 {
+		t.Errorf("resized to %dx%d, want about 632x316", w, h)
+	}
+
+	// normalizing keeps the size, as a JPG
+	if err = (goImager{}).Normalize(out, src); err != nil {
+		t.Fatal(err)
+	}
+	if jpg, err := isJpeg(out); err != nil || !jpg {
+		t.Errorf("normalized to JPEG %v, %v", jpg, err)
+	}
+	if w, h, err = (goImager{}).Identify(out); err != nil || w != 2000 || h != 1000 {
+		t.Errorf("normalized to %dx%d, %v", w, h, err)
+	}
+}
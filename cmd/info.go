@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// infoCmd represents the info command
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Describes the overlays in a KMZ and whether a Garmin can use it",
+	Long: `Opens each given KMZ, reads its doc.kml and reports its GroundOverlays:
+each tile's pixel size, megapixels, file size, image format, whether
+it is a progressive JPEG and its drawOrder, plus the bounding box of
+them all.
+
+Anything breaking the Garmin limits of --device (see 'cutkmz kmz -h')
+is flagged:
+  * tile is not a JPEG or is a progressive JPEG
+  * tile is over the device's max pixels (1MP) or its file over its
+    max bytes (3MB)
+  * more tiles than the device allows, or --max_tiles
+  * drawOrder 50 or lower, which Garmins do not show
+  * no /doc.kml, or other .kml files Garmins will ignore
+
+Exits with an error if any problems are found.
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processInfo(viper.GetViper(), os.Stdout, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz info -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(infoCmd)
+
+	infoCmd.Flags().String("device", defaultDevice, "GPS model whose limits to check: "+deviceNames()+", or one from the config file.")
+	viper.BindPFlag("device", infoCmd.Flags().Lookup("device"))
+
+	infoCmd.Flags().IntP("max_tiles", "t", 0, "max tiles the device allows. 0 means the device's limit.")
+	viper.BindPFlag("max_tiles", infoCmd.Flags().Lookup("max_tiles"))
+
+	infoCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, infoCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// tileInfo describes an overlay's image inside a KMZ
+type tileInfo struct {
+	format      string // as image.DecodeConfig names it, e.g. "jpeg"
+	width       int
+	height      int
+	bytes       int64
+	progressive bool
+}
+
+// processInfo writes a report on each KMZ in args to w. Uses
+// "device" and "max_tiles" from viper. Returns an error if any KMZ
+// breaks a limit of the device.
+func processInfo(v *viper.Viper, w io.Writer, args []string) error {
+	dev, err := deviceFromFlags(v)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("KMZ file required: must provide one or more KMZ file path")
+	}
+	problems := 0
+	for _, kmz := range args {
+		n, err := kmzInfo(w, kmz, dev)
+		if err != nil {
+			return err
+		}
+		problems += n
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found for device %v", problems, dev.name)
+	}
+	return nil
+}
+
+// kmzInfo writes a report on the given KMZ to w, returning how many
+// problems it has for the device
+func kmzInfo(w io.Writer, kmz string, dev *device) (problems int, err error) {
+	problem := func(format string, a ...interface{}) {
+		problems++
+		fmt.Fprintf(w, "  PROBLEM: "+format+"\n", a...)
+	}
+
+	zr, err := zip.OpenReader(kmz)
+	if err != nil {
+		return 0, fmt.Errorf("Error opening KMZ %v: %v", kmz, err)
+	}
+	defer zr.Close()
+	fi, err := os.Stat(kmz)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(w, "%v: %d bytes, %d files\n", kmz, fi.Size(), len(zr.File))
+
+	doc, err := kmzDocKML(&zr.Reader)
+	if err != nil {
+		return 0, fmt.Errorf("Error with KMZ %v: %v", kmz, err)
+	}
+	files := kmzFiles(&zr.Reader)
+	for _, f := range zr.File {
+		if strings.EqualFold(path.Ext(f.Name), ".kml") && f != doc {
+			problem("%v is ignored, only /doc.kml is read", f.Name)
+		}
+	}
+	if doc.Name != "doc.kml" {
+		problem("no /doc.kml, %v is used instead", doc.Name)
+	}
+	r, err := doc.Open()
+	if err != nil {
+		return 0, err
+	}
+	overlays, err := readKMLOverlays(r)
+	r.Close()
+	if err != nil {
+		return 0, fmt.Errorf("Error with KMZ %v: %v", kmz, err)
+	}
+
+	fmt.Fprintf(w, "  %d GroundOverlays\n", len(overlays))
+	if len(overlays) > dev.maxTiles {
+		problem("%d overlays is more than the %d tile limit", len(overlays), dev.maxTiles)
+	}
+	for _, o := range overlays {
+		fmt.Fprintf(w, "  %v: %v drawOrder %d", o.Name, o.Icon.Href, o.DrawOrder)
+		zf := files[path.Clean(o.Icon.Href)]
+		if zf == nil {
+			fmt.Fprintln(w)
+			problem("%v image %v is not in the KMZ", o.Name, o.Icon.Href)
+			continue
+		}
+		ti, err := zipTileInfo(zf)
+		if err != nil {
+			fmt.Fprintln(w)
+			problem("%v image %v: %v", o.Name, o.Icon.Href, err)
+			continue
+		}
+		fmt.Fprintf(w, " %dx%d %.2fMP %d bytes %v", ti.width, ti.height, float64(ti.width*ti.height)/megaPixel, ti.bytes, ti.format)
+		if ti.progressive {
+			fmt.Fprintf(w, " progressive")
+		}
+		fmt.Fprintln(w)
+		if ti.format != "jpeg" {
+			problem("%v image is %v, not JPEG", o.Name, ti.format)
+		}
+		if ti.progressive {
+			problem("%v image is a progressive JPEG", o.Name)
+		}
+		if ti.width*ti.height > dev.maxTilePixels {
+			problem("%v image is over %d pixels, the extra pixels add no clarity", o.Name, dev.maxTilePixels)
+		}
+		if ti.bytes > dev.maxTileBytes {
+			problem("%v image file is over %d bytes", o.Name, dev.maxTileBytes)
+		}
+		if o.DrawOrder < garminMinDrawOrder {
+			problem("%v drawOrder %d is not over 50 so will not be shown", o.Name, o.DrawOrder)
+		}
+		if o.LatLonBox == nil && o.LatLonQuad != nil {
+			problem("%v is placed with a gx:LatLonQuad, Garmins need a LatLonBox", o.Name)
+		} else if o.LatLonBox == nil {
+			problem("%v has no LatLonBox", o.Name)
+		}
+	}
+	if box, err := overlaysBox(overlays); err == nil {
+		fmt.Fprintf(w, "  bounding box N: %v S: %v E: %v W: %v\n", box[north], box[south], box[east], box[west])
+	}
+	return problems, nil
+}
+
+// zipTileInfo describes the image in the given zip file entry
+func zipTileInfo(zf *zip.File) (*tileInfo, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	ti := &tileInfo{format: format, width: cfg.Width, height: cfg.Height, bytes: int64(len(b))}
+	if format == "jpeg" {
+		if ti.progressive, err = jpegIsProgressive(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	}
+	return ti, nil
+}
+
+// jpegIsProgressive returns true if the JPEG read from r has a
+// progressive start of frame marker
+func jpegIsProgressive(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return false, fmt.Errorf("Not a JPEG")
+	}
+	for {
+		var m [2]byte
+		if _, err := io.ReadFull(br, m[:]); err != nil {
+			return false, fmt.Errorf("No JPEG start of frame found: %v", err)
+		}
+		for m[1] == 0xff { // fill bytes
+			b, err := br.ReadByte()
+			if err != nil {
+				return false, err
+			}
+			m[1] = b
+		}
+		if m[0] != 0xff {
+			return false, fmt.Errorf("Bad JPEG marker %x", m)
+		}
+		switch m[1] {
+		case 0xc0, 0xc1, 0xc3, 0xc5, 0xc7, 0xc9, 0xcb, 0xcd, 0xcf: // baseline, sequential, lossless
+			return false, nil
+		case 0xc2, 0xc6, 0xca, 0xce:
+			return true, nil
+		}
+		var size uint16
+		if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+			return false, err
+		}
+		if size < 2 {
+			return false, fmt.Errorf("Bad JPEG segment size %d", size)
+		}
+		if _, err := br.Discard(int(size) - 2); err != nil {
+			return false, err
+		}
+	}
+}
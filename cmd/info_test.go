@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestJpegIsProgressive(t *testing.T) {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := jpegIsProgressive(bytes.NewReader(b.Bytes()))
+	if err != nil || prog {
+		t.Errorf("Baseline JPEG seen as progressive %v or error %v", prog, err)
+	}
+
+	// go only writes baseline, so fake a progressive start of frame
+	p := b.Bytes()
+	i := bytes.Index(p, []byte{0xff, 0xc0})
+	if i < 0 {
+		t.Fatal("No baseline start of frame")
+	}
+	p[i+1] = 0xc2
+	prog, err = jpegIsProgressive(bytes.NewReader(p))
+	if err != nil || !prog {
+		t.Errorf("Progressive JPEG not seen %v or error %v", prog, err)
+	}
+
+	if _, err = jpegIsProgressive(bytes.NewReader([]byte("GIF89a"))); err == nil {
+		t.Errorf("Expected error for non-JPEG")
+	}
+}
+
+func TestKMZInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a KMZ of a PNG tile, a tile over 1MP and drawOrder 40, a good
+	// tile and a KML Garmins ignore
+	kmzDir := filepath.Join(dir, "bad")
+	if err = os.MkdirAll(filepath.Join(kmzDir, "tiles"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var pngBuf bytes.Buffer
+	if err = png.Encode(&pngBuf, image.NewGray(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatal(err)
+	}
+	tiles := map[string][]byte{
+		"tiles/a.png": pngBuf.Bytes(),
+		"tiles/b.jpg": testJpg(t, 1100, 1000, color.White),
+		"tiles/c.jpg": testJpg(t, 100, 100, color.White),
+		"extra.kml":   []byte(`<kml/>`),
+	}
+	for name, b := range tiles {
+		if err = ioutil.WriteFile(filepath.Join(kmzDir, filepath.FromSlash(name)), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	doc := &kmlDocument{Name: "bad", Overlays: []*kmlOverlay{
+		newKMLOverlay("a", [4]float64{50, 49.5, -122.5, -123}, 0, 60, "", "tiles/a.png"),
+		newKMLOverlay("b", [4]float64{50, 49.5, -122, -122.5}, 0, 40, "", "tiles/b.jpg"),
+		newKMLOverlay("c", [4]float64{49.5, 49, -122, -122.5}, 0, 51, "", "tiles/c.jpg"),
+	}}
+	f, err := os.Create(filepath.Join(kmzDir, "doc.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeKML(f, doc); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	kmz := filepath.Join(dir, "bad.kmz")
+	if f, err = os.Create(kmz); err != nil {
+		t.Fatal(err)
+	}
+	if err = zipd(kmzDir, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	v := viper.New()
+	v.Set("max_tiles", 2)
+	var out bytes.Buffer
+	err = processInfo(v, &out, []string{kmz})
+	if err == nil || !strings.HasPrefix(err.Error(), "5 problem(s)") {
+		t.Errorf("got error %v, want 5 problems", err)
+	}
+	for _, want := range []string{
+		"3 GroundOverlays",
+		"bounding box N: 50 S: 49 E: -122 W: -123",
+		"PROBLEM: extra.kml is ignored",
+		"PROBLEM: 3 overlays is more than the 2 tile limit",
+		"PROBLEM: a image is png, not JPEG",
+		"PROBLEM: b image is over 1048576 pixels",
+		"PROBLEM: b drawOrder 40 is not over 50",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report has no %q:\n%v", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "PROBLEM: c ") {
+		t.Errorf("good tile c flagged:\n%v", out.String())
+	}
+}
@@ -0,0 +1,489 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// jnxCmd represents the jnx command
+var jnxCmd = &cobra.Command{
+	Use:   "jnx",
+	Short: "Produces a Garmin JNX (BirdsEye) raster map",
+	Long: `Renders the name-geo-anchored JPG (or GeoTIFF or image with a world
+file, as for the kmz subcommand) into a Garmin JNX file, the BirdsEye
+raster format, e.g.
+
+    cutkmz jnx Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+creates Grouse-Mountain.jnx in the current directory, or the file
+given by --out. Copy it to the device's /Garmin/BirdsEye directory.
+Unlike KMZ custom maps, JNX maps are not limited to 100-500 tiles, so
+much larger areas can be carried at full resolution.
+
+A JNX holds up to 5 levels of 256x256 JPG tiles, each a coarser copy
+of the map, and the device shows the level whose scale best suits
+its zoom. By default the finest level is at the image's resolution
+and each coarser one half that of the one before, until the map fits
+in one tile or there are 5 levels. Give --levels for fewer, or
+--scales to choose each level's scale: its metres per pixel times
+1000, e.g. 4777, 9554, 19109, 38218, 76437 for the resolutions of web
+map zooms 15 to 11. No level may be finer than the image. A level
+may have at most 50000 tiles and the file must be under 4GB; for
+larger maps, choose coarser scales or cut the image up.
+
+JNX maps cannot cross 180 degrees.
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processJNX(viper.GetViper(), args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz jnx -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(jnxCmd)
+
+	jnxCmd.Flags().Int("levels", 0, "number of levels, 1 to 5, each half the resolution of the one before. 0 means until the map fits in one tile.")
+	viper.BindPFlag("levels", jnxCmd.Flags().Lookup("levels"))
+
+	jnxCmd.Flags().String("scales", "", "comma separated scale of each level, metres per pixel x 1000, e.g. 4777,19109,76437. Overrides --levels.")
+	viper.BindPFlag("scales", jnxCmd.Flags().Lookup("scales"))
+
+	jnxCmd.Flags().IntP("drawing_order", "d", jnxDefaultZOrder, "JNX z-order, 0-100. Maps with higher values are drawn over those with lower.")
+	viper.BindPFlag("drawing_order", jnxCmd.Flags().Lookup("drawing_order"))
+
+	jnxCmd.Flags().StringP("out", "o", "", "JNX file to write. Default is the map's name with .jnx added.")
+	viper.BindPFlag("out", jnxCmd.Flags().Lookup("out"))
+
+	jnxCmd.Flags().Int("src_crs", 0, "EPSG code of a projected world file or GeoTIFF, e.g. 32610 for UTM zone 10N. Reprojects to lat/long.")
+	viper.BindPFlag("src_crs", jnxCmd.Flags().Lookup("src_crs"))
+
+	jnxCmd.Flags().BoolP("keep_tmp", "k", false, "Don't delete intermediate files from $TMPDIR.")
+	viper.BindPFlag("keep_tmp", jnxCmd.Flags().Lookup("keep_tmp"))
+
+	jnxCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, jnxCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// JNX limits and defaults
+const (
+	jnxVersion       = 4
+	jnxMaxLevels     = 5
+	jnxMaxLevelTiles = 50000
+	jnxTileSize      = 256
+	jnxDefaultZOrder = 30
+	jnxHeaderSize    = 13 * 4 // int32s of version 4
+	jnxTileInfoSize  = 7 * 4  // bounds, width & height int16s, size, offset
+)
+
+// jnxTile is a tile of a JNX level: its JPG and lat/long box
+type jnxTile struct {
+	fpath         string
+	box           []float64
+	width, height int
+	size          int64 // of the JPG
+}
+
+// jnxLevel is a level of a JNX, its tiles and scale
+type jnxLevel struct {
+	scale int
+	size  image.Point // of the level's image
+	tiles []*jnxTile
+}
+
+// jnxUnits returns the degrees in JNX units, 2^31 of them to 180
+// degrees
+func jnxUnits(deg float64) int32 {
+	return int32(math.Round(deg / 180 * math.MaxInt32))
+}
+
+// metresPerDegree is the length of a degree of longitude at the
+// equator
+var metresPerDegree = 2 * math.Pi * wgs84.a / 360
+
+// jnxScale returns the JNX scale of a level with the given degrees of
+// longitude per pixel: its metres per pixel at the equator x 1000
+func jnxScale(degPerPix float64) int {
+	return int(math.Round(degPerPix * metresPerDegree * 1000))
+}
+
+// parseScales parses the comma separated --scales, returning them
+// coarsest first. Nil if s is empty.
+func parseScales(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var scales []int
+	for _, c := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing scales: %v", err)
+		}
+		if i <= 0 {
+			return nil, fmt.Errorf("Scales must be more than 0, got %d", i)
+		}
+		scales = append(scales, i)
+	}
+	if len(scales) > jnxMaxLevels {
+		return nil, fmt.Errorf("JNX maps have at most %d levels, got %d scales", jnxMaxLevels, len(scales))
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(scales)))
+	return scales, nil
+}
+
+// planJNXLevels returns the levels, coarsest first, of the width x
+// height image covering box: those of the given scales if any,
+// otherwise levels of them halving the resolution each time from the
+// image's, or until the map fits in one tile if levels is 0
+func planJNXLevels(width, height int, box []float64, levels int, scales []int) ([]*jnxLevel, error) {
+	if levels < 0 || levels > jnxMaxLevels {
+		return nil, fmt.Errorf("JNX maps have 1 to %d levels, got %d", jnxMaxLevels, levels)
+	}
+	degPerPix := eastDelta(box[east], box[west]) / float64(width)
+	finest := jnxScale(degPerPix)
+	var ls []*jnxLevel
+	if scales == nil {
+		for i := 0; levels == 0 || i < levels; i++ {
+			div := 1 << uint(i)
+			size := image.Pt((width+div-1)/div, (height+div-1)/div)
+			ls = append([]*jnxLevel{{scale: finest * div, size: size}}, ls...)
+			if levels == 0 && (i+1 == jnxMaxLevels || size.X <= jnxTileSize && size.Y <= jnxTileSize) {
+				break
+			}
+		}
+	} else {
+		for _, s := range scales {
+			if s < finest {
+				return nil, fmt.Errorf("Scale %d is finer than the image's %d", s, finest)
+			}
+			f := float64(finest) / float64(s)
+			size := image.Pt(int(math.Max(1, math.Round(float64(width)*f))), int(math.Max(1, math.Round(float64(height)*f))))
+			ls = append(ls, &jnxLevel{scale: s, size: size})
+		}
+	}
+	for _, l := range ls {
+		tl := jnxLayout(l.size)
+		if tl.tiles() > jnxMaxLevelTiles {
+			return nil, fmt.Errorf("Level of scale %d needs %d tiles, more than the %d JNX allows: choose coarser scales or cut the image up",
+				l.scale, tl.tiles(), jnxMaxLevelTiles)
+		}
+	}
+	return ls, nil
+}
+
+// jnxLayout returns the layout of a level's tiles
+func jnxLayout(size image.Point) tileLayout {
+	return tileLayout{
+		cols:   (size.X + jnxTileSize - 1) / jnxTileSize,
+		rows:   (size.Y + jnxTileSize - 1) / jnxTileSize,
+		width:  jnxTileSize,
+		height: jnxTileSize,
+	}
+}
+
+// processJNX writes a JNX for each image in args. Uses "levels",
+// "scales", "drawing_order", "out", "src_crs" and "keep_tmp" from
+// viper if present.
+func processJNX(v *viper.Viper, args []string) error {
+	out := v.GetString("out")
+	keepTmp := v.GetBool("keep_tmp")
+	zOrder := v.GetInt("drawing_order")
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("Image file required: must provide one or more image file path")
+	}
+	if len(args) > 1 && out != "" {
+		return fmt.Errorf("Only one image at a time can be written to an --out file")
+	}
+	if zOrder < 0 || zOrder > 100 {
+		return fmt.Errorf("JNX drawing order must be in [0,100], got %d", zOrder)
+	}
+	scales, err := parseScales(v.GetString("scales"))
+	if err != nil {
+		return err
+	}
+	for _, image := range args {
+		if _, err := os.Stat(image); os.IsNotExist(err) {
+			return err
+		}
+		tmpDir, err := ioutil.TempDir("", "cutkmz-")
+		if err != nil {
+			return fmt.Errorf("Error creating a temporary directory: %v", err)
+		}
+		base, img, box, err := latLongMap(ib, tmpDir, image, v.GetInt("src_crs"))
+		if err != nil {
+			return err
+		}
+		if box[east] < box[west] {
+			return fmt.Errorf("JNX maps cannot cross 180 degrees, %v does", image)
+		}
+		width, height, err := ib.Identify(img)
+		if err != nil {
+			return err
+		}
+		levels, err := planJNXLevels(width, height, box, v.GetInt("levels"), scales)
+		if err != nil {
+			return err
+		}
+		if err = cutJNXLevels(ib, img, tmpDir, box, levels); err != nil {
+			return err
+		}
+		jnx := out
+		if jnx == "" {
+			jnx = base + ".jnx"
+		}
+		f, err := os.Create(jnx)
+		if err != nil {
+			return err
+		}
+		if err = writeJNX(f, base, box, levels, zOrder); err != nil {
+			f.Close()
+			return fmt.Errorf("Error writing %v: %v", jnx, err)
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		n := 0
+		for _, l := range levels {
+			n += len(l.tiles)
+		}
+		fmt.Printf("%v: %d levels, %d tiles\n", jnx, len(levels), n)
+
+		if !keepTmp {
+			if err = os.RemoveAll(tmpDir); err != nil {
+				return fmt.Errorf("Error removing tmp dir & contents: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// cutJNXLevels reduces the lat/long image img covering box to the size
+// of each level, finest first, and cuts it into the level's tiles in
+// tmpDir
+func cutJNXLevels(ib ImageBackend, img, tmpDir string, box []float64, levels []*jnxLevel) error {
+	width, height, err := ib.Identify(img)
+	if err != nil {
+		return err
+	}
+	levelImg := img
+	for i := len(levels) - 1; i >= 0; i-- {
+		l := levels[i]
+		if l.size.X*l.size.Y < width*height {
+			reduced := filepath.Join(tmpDir, fmt.Sprintf("level-%d.jpg", i))
+			if err = ib.Resize(reduced, levelImg, l.size.X*l.size.Y); err != nil {
+				return fmt.Errorf("Error reducing image for JNX level %d: %v", i, err)
+			}
+			levelImg = reduced
+			if width, height, err = ib.Identify(levelImg); err != nil {
+				return err
+			}
+		}
+		l.size = image.Pt(width, height)
+		tl := jnxLayout(l.size)
+		glog.Infof("JNX level %d scale %d is %d %dx%d tiles of %v\n", i, l.scale, tl.tiles(), jnxTileSize, jnxTileSize, levelImg)
+
+		cropDir := filepath.Join(tmpDir, fmt.Sprintf("level-%d", i))
+		if err = os.MkdirAll(cropDir, 0755); err != nil {
+			return err
+		}
+		if err = ib.Crop(levelImg, cropDir, "level", tl); err != nil {
+			return fmt.Errorf("Error chopping JNX level %d into tiles: %v", i, err)
+		}
+		l.tiles = nil
+		bounds := image.Rect(0, 0, width, height)
+		for t := 0; t < tl.tiles(); t++ {
+			r := tl.tileRect(t, bounds)
+			fpath := tileFile(cropDir, "level", t)
+			fi, err := os.Stat(fpath)
+			if err != nil {
+				return err
+			}
+			l.tiles = append(l.tiles, &jnxTile{
+				fpath:  fpath,
+				box:    subBox(box, r, width, height, true),
+				width:  r.Dx(),
+				height: r.Dy(),
+				size:   fi.Size(),
+			})
+		}
+	}
+	return nil
+}
+
+// jnxRect is a box in JNX units in the order JNXs store them
+type jnxRect struct {
+	North, East, South, West int32
+}
+
+// newJNXRect returns the JNX rect of the north, south, east, west box
+func newJNXRect(box []float64) jnxRect {
+	return jnxRect{jnxUnits(box[north]), jnxUnits(box[east]), jnxUnits(box[south]), jnxUnits(box[west])}
+}
+
+// jnxHeader is the start of a version 4 JNX. Its product, CRC and
+// signature fields are left 0, as for maps not sold by Garmin.
+type jnxHeader struct {
+	Version, DeviceSN int32
+	Bounds            jnxRect
+	Levels            int32
+	Expiration        int32
+	ProductID         int32
+	CRC               int32
+	SignatureVersion  int32
+	SignatureOffset   uint32
+	ZOrder            int32
+}
+
+// jnxTileInfo is a tile's entry in its level's tile table
+type jnxTileInfo struct {
+	Bounds        jnxRect
+	Width, Height uint16
+	Size, Offset  uint32
+}
+
+// jnxCString returns s as the null terminated string JNXs hold
+func jnxCString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// writeJNX writes a version 4 JNX of the named map covering box with
+// the given levels, coarsest first, to w: the header, level infos, map
+// info, each level's tile table, then the tiles' JPGs without their
+// start of image markers, then the "BirdsEye" trailer
+func writeJNX(w io.Writer, name string, box []float64, levels []*jnxLevel, zOrder int) error {
+	le := binary.LittleEndian
+	guid := fmt.Sprintf("%X", md5.Sum([]byte(name)))
+	guid = guid[0:8] + "-" + guid[8:12] + "-" + guid[12:16] + "-" + guid[16:20] + "-" + guid[20:32]
+
+	// map info, after the level infos
+	var info bytes.Buffer
+	binary.Write(&info, le, int32(9)) // map info version
+	info.Write(jnxCString(guid))
+	info.Write(jnxCString(name))
+	info.Write(jnxCString(""))
+	binary.Write(&info, le, int16(0))
+	info.Write(jnxCString(name))
+	binary.Write(&info, le, int32(len(levels)))
+	for i, l := range levels {
+		info.Write(jnxCString(fmt.Sprintf("Level %d", i+1)))
+		info.Write(jnxCString(fmt.Sprintf("Scale %d", l.scale)))
+		info.Write(jnxCString(""))
+		binary.Write(&info, le, int32(i+1))
+	}
+
+	// level infos, whose size doesn't depend on the offsets in them
+	offset := int64(jnxHeaderSize + info.Len())
+	for range levels {
+		offset += 4*4 + int64(len(jnxCString("")))
+	}
+	var levelInfo bytes.Buffer
+	for _, l := range levels {
+		binary.Write(&levelInfo, le, int32(len(l.tiles)))
+		binary.Write(&levelInfo, le, uint32(offset))
+		binary.Write(&levelInfo, le, int32(l.scale))
+		binary.Write(&levelInfo, le, int32(2))
+		levelInfo.Write(jnxCString("")) // copyright
+		offset += int64(len(l.tiles)) * jnxTileInfoSize
+	}
+
+	// tile tables, pointing at the tiles' data after them all
+	var tables bytes.Buffer
+	for _, l := range levels {
+		for _, t := range l.tiles {
+			if t.size < 2 {
+				return fmt.Errorf("Tile %v is not a JPG", t.fpath)
+			}
+			binary.Write(&tables, le, jnxTileInfo{
+				Bounds: newJNXRect(t.box),
+				Width:  uint16(t.width),
+				Height: uint16(t.height),
+				Size:   uint32(t.size - 2),
+				Offset: uint32(offset),
+			})
+			offset += t.size - 2
+		}
+	}
+	if offset > math.MaxUint32 {
+		return fmt.Errorf("JNX files must be under 4GB, this one would be %d bytes: choose coarser scales or cut the image up", offset)
+	}
+
+	bw := bufio.NewWriter(w)
+	hdr := jnxHeader{
+		Version: jnxVersion,
+		Bounds:  newJNXRect(box),
+		Levels:  int32(len(levels)),
+		ZOrder:  int32(zOrder),
+	}
+	if err := binary.Write(bw, le, &hdr); err != nil {
+		return err
+	}
+	for _, b := range [][]byte{levelInfo.Bytes(), info.Bytes(), tables.Bytes()} {
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, l := range levels {
+		for _, t := range l.tiles {
+			if err := copyJNXTile(bw, t); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := bw.WriteString("BirdsEye"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// copyJNXTile writes the tile's JPG to w without its leading FFD8
+// start of image marker, as JNXs store them
+func copyJNXTile(w io.Writer, t *jnxTile) error {
+	f, err := os.Open(t.fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var soi [2]byte
+	if _, err = io.ReadFull(f, soi[:]); err != nil {
+		return err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return fmt.Errorf("Tile %v is not a JPG", t.fpath)
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return err
+	}
+	if n != t.size-2 {
+		return fmt.Errorf("Tile %v changed size while writing the JNX", t.fpath)
+	}
+	return nil
+}
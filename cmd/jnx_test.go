@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanJNXLevels(t *testing.T) {
+	box := []float64{50, 49, -122, -123}
+	ls, err := planJNXLevels(1000, 500, box, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1000x500, 500x250 then 250x125 fits one tile
+	if len(ls) != 3 || ls[0].size != image.Pt(250, 125) || ls[2].size != image.Pt(1000, 500) {
+		t.Fatalf("got %d levels", len(ls))
+	}
+	if ls[0].scale != 4*ls[2].scale || ls[2].scale != 111319 {
+		t.Errorf("scales %d, %d", ls[0].scale, ls[2].scale)
+	}
+
+	scales, err := parseScales("200000, 400000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls, err = planJNXLevels(1000, 500, box, 0, scales); err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 2 || ls[0].scale != 400000 || ls[1].size != image.Pt(557, 278) {
+		t.Errorf("got levels %+v %+v", ls[0], ls[1])
+	}
+	if _, err = planJNXLevels(1000, 500, box, 0, []int{1000}); err == nil {
+		t.Errorf("expected error for a scale finer than the image")
+	}
+	if _, err = planJNXLevels(100000, 50000, []float64{50, 40, 0, -20}, 1, nil); err == nil {
+		t.Errorf("expected error for too many tiles in a level")
+	}
+	if _, err = parseScales("1,2,3,4,5,6"); err == nil {
+		t.Errorf("expected error for more than 5 levels")
+	}
+}
+
+func TestProcessJNX(t *testing.T) {
+	dir, src, v := writeTestMap(t, 600, 300)
+	defer os.RemoveAll(dir)
+	jnx := filepath.Join(dir, "sector.jnx")
+	v.Set("levels", 2)
+	v.Set("drawing_order", 30)
+	v.Set("out", jnx)
+	if err := processJNX(v, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(jnx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	var hdr jnxHeader
+	if err = binary.Read(bytes.NewReader(b), le, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != 4 || hdr.Levels != 2 || hdr.ZOrder != 30 || hdr.Bounds != newJNXRect([]float64{50, 49, -122, -123}) {
+		t.Errorf("header %+v", hdr)
+	}
+	if !bytes.HasSuffix(b, []byte("BirdsEye")) {
+		t.Errorf("no BirdsEye trailer")
+	}
+
+	// second level is 600x300, 3x2 tiles
+	p := jnxHeaderSize + 17
+	tiles, offset := le.Uint32(b[p:]), le.Uint32(b[p+4:])
+	if tiles != 6 {
+		t.Fatalf("second level has %d tiles, want 6", tiles)
+	}
+	// first tile is the NW corner, last the SE
+	tile := func(i uint32) (jnxTileInfo, image.Image) {
+		var ti jnxTileInfo
+		if err = binary.Read(bytes.NewReader(b[offset+i*jnxTileInfoSize:]), le, &ti); err != nil {
+			t.Fatal(err)
+		}
+		jpg := append([]byte{0xff, 0xd8}, b[ti.Offset:ti.Offset+ti.Size]...)
+		img, err := jpeg.Decode(bytes.NewReader(jpg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != int(ti.Width) || img.Bounds().Dy() != int(ti.Height) {
+			t.Errorf("tile %d image is %v", i, img.Bounds())
+		}
+		return ti, img
+	}
+	ti, img := tile(0)
+	if ti.Bounds.North != jnxUnits(50) || ti.Bounds.West != jnxUnits(-123) {
+		t.Errorf("first tile bounds %+v", ti.Bounds)
+	}
+	checkColor(t, "first tile", img, image.Pt(128, 128), nw)
+	ti, img = tile(5)
+	if ti.Width != 600-512 || ti.Height != 300-256 {
+		t.Errorf("last tile is %dx%d", ti.Width, ti.Height)
+	}
+	if ti.Bounds.South != jnxUnits(49) || ti.Bounds.East != jnxUnits(-122) {
+		t.Errorf("last tile bounds %+v", ti.Bounds)
+	}
+	checkColor(t, "last tile", img, image.Pt(44, 22), se)
+}
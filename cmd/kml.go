@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// kmlGxNS is the namespace of Google's KML extensions, e.g.
+// gx:LatLonQuad
+const kmlGxNS = "http://www.google.com/kml/ext/2.2"
+
+// kmlRoot is the <kml> element of the KML written to KMZs
+type kmlRoot struct {
+	XMLName  xml.Name     `xml:"http://www.opengis.net/kml/2.2 kml"`
+	XmlnsGx  string       `xml:"xmlns:gx,attr"`
+	Document *kmlDocument `xml:"Document"`
+}
+
+// kmlDocument holds the Folders, GroundOverlays and NetworkLinks of
+// a KML, shown only within its Region if it has one
+type kmlDocument struct {
+	Name         string            `xml:"name"`
+	Region       *kmlRegion        `xml:"Region,omitempty"`
+	Folders      []*kmlFolder      `xml:"Folder"`
+	Overlays     []*kmlOverlay     `xml:"GroundOverlay"`
+	NetworkLinks []*kmlNetworkLink `xml:"NetworkLink"`
+}
+
+// kmlFolder groups GroundOverlays, e.g. those of one map
+type kmlFolder struct {
+	Name     string        `xml:"name"`
+	Overlays []*kmlOverlay `xml:"GroundOverlay"`
+}
+
+// kmlOverlay is a GroundOverlay written to a KML, placed by either a
+// LatLonBox or a gx:LatLonQuad
+type kmlOverlay struct {
+	Name       string         `xml:"name"`
+	Region     *kmlRegion     `xml:"Region,omitempty"`
+	Color      string         `xml:"color"`
+	DrawOrder  int            `xml:"drawOrder"`
+	Icon       kmlIcon        `xml:"Icon"`
+	LatLonBox  *kmlLatLonBox  `xml:"LatLonBox,omitempty"`
+	LatLonQuad *kmlLatLonQuad `xml:"gx:LatLonQuad,omitempty"`
+}
+
+// kmlNetworkLink loads another KML, e.g. one in the same KMZ, when
+// its Region if any comes into view
+type kmlNetworkLink struct {
+	Name   string     `xml:"name"`
+	Region *kmlRegion `xml:"Region,omitempty"`
+	Link   kmlLink    `xml:"Link"`
+}
+
+// kmlLink is the KML a NetworkLink loads, relative to the KML
+// linking to it
+type kmlLink struct {
+	Href            string `xml:"href"`
+	ViewRefreshMode string `xml:"viewRefreshMode,omitempty"` // e.g. onRegion
+}
+
+// kmlIcon is the image of a GroundOverlay
+type kmlIcon struct {
+	Href           string  `xml:"href"`
+	ViewBoundScale float64 `xml:"viewBoundScale"`
+}
+
+// kmlLatLonBox places a GroundOverlay by its edges in decimal
+// degrees, rotated counter-clockwise about its centre by Rotation
+// degrees
+type kmlLatLonBox struct {
+	North    float64 `xml:"north"`
+	South    float64 `xml:"south"`
+	East     float64 `xml:"east"`
+	West     float64 `xml:"west"`
+	Rotation float64 `xml:"rotation"`
+}
+
+// kmlLatLonQuad places a GroundOverlay by its corners as "long,lat"
+// pairs separated by spaces in SW, SE, NE, NW order
+type kmlLatLonQuad struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// kmlRegion limits when a feature is shown to when its box is in view
+// and covers as many screen pixels as its Lod allows
+type kmlRegion struct {
+	LatLonAltBox kmlLatLonAltBox `xml:"LatLonAltBox"`
+	Lod          *kmlLod         `xml:"Lod,omitempty"`
+}
+
+// kmlLatLonAltBox is a Region's box in decimal degrees
+type kmlLatLonAltBox struct {
+	North float64 `xml:"north"`
+	South float64 `xml:"south"`
+	East  float64 `xml:"east"`
+	West  float64 `xml:"west"`
+}
+
+// newKMLRegion returns the Region of the north, south, east, west
+// box shown from minLod screen pixels up
+func newKMLRegion(box []float64, minLod int) *kmlRegion {
+	return &kmlRegion{
+		LatLonAltBox: kmlLatLonAltBox{North: box[north], South: box[south], East: box[east], West: box[west]},
+		Lod:          &kmlLod{MinLodPixels: minLod, MaxLodPixels: -1},
+	}
+}
+
+// kmlLod is the range of screen pixels a Region is shown at. -1 max
+// means no limit.
+type kmlLod struct {
+	MinLodPixels int `xml:"minLodPixels"`
+	MaxLodPixels int `xml:"maxLodPixels"`
+}
+
+// newKMLOverlay returns a GroundOverlay of the image at href placed
+// by the given box, rotated counter-clockwise about its centre by
+// rotation degrees, with the given aabbggrr KML colour
+func newKMLOverlay(name string, box [4]float64, rotation float64, drawOrder int, color, href string) *kmlOverlay {
+	return &kmlOverlay{
+		Name:      name,
+		Color:     color,
+		DrawOrder: drawOrder,
+		Icon:      kmlIcon{Href: href, ViewBoundScale: 1},
+		LatLonBox: &kmlLatLonBox{North: box[north], South: box[south], East: box[east], West: box[west], Rotation: rotation},
+	}
+}
+
+// newKMLQuadOverlay returns a GroundOverlay of the image at href
+// placed by its four corners in NW, NE, SE, SW order using a
+// gx:LatLonQuad, with the given aabbggrr KML colour
+func newKMLQuadOverlay(name string, quad [4][2]float64, drawOrder int, color, href string) *kmlOverlay {
+	var coords []string
+	for _, c := range [4][2]float64{quad[sw], quad[se], quad[ne], quad[nw]} { // KML's order
+		coords = append(coords, strconv.FormatFloat(c[cornerLon], 'f', -1, 64)+","+strconv.FormatFloat(c[cornerLat], 'f', -1, 64))
+	}
+	return &kmlOverlay{
+		Name:       name,
+		Color:      color,
+		DrawOrder:  drawOrder,
+		Icon:       kmlIcon{Href: href, ViewBoundScale: 1},
+		LatLonQuad: &kmlLatLonQuad{Coordinates: strings.Join(coords, " ")},
+	}
+}
+
+// writeKML writes the document as a KML file, escaping names etc. as
+// need be
+func writeKML(w io.Writer, doc *kmlDocument) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(&kmlRoot{XmlnsGx: kmlGxNS, Document: doc}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
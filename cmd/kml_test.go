@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteKML(t *testing.T) {
+	quad := [4][2]float64{{50, -123}, {50.1, -122}, {49, -121.9}, {48.9, -123.1}}
+	doc := &kmlDocument{
+		Name: `Trail & Road <"North">`,
+		Folders: []*kmlFolder{{
+			Name:     "Sector 1 & 2",
+			Overlays: []*kmlOverlay{newKMLQuadOverlay("q&a", quad, 52, "ffffffff", "tiles/q.jpg")},
+		}},
+		Overlays: []*kmlOverlay{newKMLOverlay("a<b", [4]float64{50, 49, -122, -123}, 12.5, 51, "bdffffff", "tiles/a&b.jpg")},
+	}
+	doc.Overlays[0].Region = &kmlRegion{
+		LatLonAltBox: kmlLatLonAltBox{North: 50, South: 49, East: -122, West: -123},
+		Lod:          &kmlLod{MinLodPixels: 128, MaxLodPixels: -1},
+	}
+	var b bytes.Buffer
+	if err := writeKML(&b, doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), xml.Header) || !strings.Contains(b.String(), "<gx:LatLonQuad>") {
+		t.Errorf("unexpected KML:\n%s", b.String())
+	}
+
+	// well-formed
+	d := xml.NewDecoder(bytes.NewReader(b.Bytes()))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v in:\n%s", err, b.String())
+		}
+	}
+
+	// and reads back
+	var r struct {
+		Document struct {
+			Name string `xml:"name"`
+		} `xml:"Document"`
+	}
+	if err := xml.Unmarshal(b.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Document.Name != doc.Name {
+		t.Errorf("got name %q, want %q", r.Document.Name, doc.Name)
+	}
+	overlays, err := readKMLOverlays(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlays) != 2 {
+		t.Fatalf("got %d overlays, want 2", len(overlays))
+	}
+	q, o := overlays[0], overlays[1]
+	if q.Name != "q&a" || q.LatLonQuad == nil || q.LatLonQuad.Coordinates != "-123.1,48.9 -121.9,49 -122,50.1 -123,50" {
+		t.Errorf("quad overlay read back as %+v %+v", q, q.LatLonQuad)
+	}
+	if o.Name != "a<b" || o.Icon.Href != "tiles/a&b.jpg" || o.DrawOrder != 51 || o.Color != "bdffffff" ||
+		o.LatLonBox == nil || *o.LatLonBox != (kmlLatLonBox{North: 50, South: 49, East: -122, West: -123, Rotation: 12.5}) {
+		t.Errorf("overlay read back as %+v %+v", o, o.LatLonBox)
+	}
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// kmlGroundOverlay is the part of a KML GroundOverlay cutkmz reads
+type kmlGroundOverlay struct {
+	Name      string `xml:"name"`
+	Color     string `xml:"color"`
+	DrawOrder int    `xml:"drawOrder"`
+	Icon      struct {
+		Href string `xml:"href"`
+	} `xml:"Icon"`
+	LatLonBox  *kmlLatLonBox  `xml:"LatLonBox"`
+	LatLonQuad *kmlLatLonQuad `xml:"http://www.google.com/kml/ext/2.2 LatLonQuad"`
+}
+
+// box returns the overlay's LatLonBox in north, south, east, west
+// order, ignoring any rotation. An error if it has none.
+func (o *kmlGroundOverlay) box() ([4]float64, error) {
+	if o.LatLonBox == nil {
+		return [4]float64{}, fmt.Errorf("GroundOverlay %q has no LatLonBox", o.Name)
+	}
+	b := o.LatLonBox
+	return [4]float64{b.North, b.South, normEasting(b.East), normEasting(b.West)}, nil
+}
+
+// kmlNetworkLinkRef is the part of a KML NetworkLink cutkmz reads: the
+// href of the KML it loads, in a Link or in KML 2.0's Url
+type kmlNetworkLinkRef struct {
+	Link struct {
+		Href string `xml:"href"`
+	} `xml:"Link"`
+	Url struct {
+		Href string `xml:"href"`
+	} `xml:"Url"`
+}
+
+// readKMLOverlays returns all the GroundOverlays in the KML read from
+// r, however deeply they are nested in Folders etc.
+func readKMLOverlays(r io.Reader) ([]*kmlGroundOverlay, error) {
+	overlays, _, err := readKML(r)
+	return overlays, err
+}
+
+// readKML returns all the GroundOverlays in the KML read from r, and
+// the hrefs of its NetworkLinks
+func readKML(r io.Reader) (overlays []*kmlGroundOverlay, links []string, err error) {
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return overlays, links, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error parsing KML: %v", err)
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "GroundOverlay":
+			o := &kmlGroundOverlay{}
+			if err = d.DecodeElement(o, &se); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing KML GroundOverlay: %v", err)
+			}
+			overlays = append(overlays, o)
+		case "NetworkLink":
+			nl := &kmlNetworkLinkRef{}
+			if err = d.DecodeElement(nl, &se); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing KML NetworkLink: %v", err)
+			}
+			if h := strings.TrimSpace(nl.Link.Href + nl.Url.Href); h != "" {
+				links = append(links, h)
+			}
+		}
+	}
+}
+
+// readKMZAllOverlays returns the GroundOverlays of every KML in the
+// KMZ: its doc KML's, then those of the KMLs its NetworkLinks load, in
+// turn, then those of any other KMLs wherever they are in it. Each
+// overlay's Icon href is made a path from the KMZ's root, as hrefs are
+// relative to the KML they are in.
+func readKMZAllOverlays(zr *zip.Reader) ([]*kmlGroundOverlay, error) {
+	var queue []string
+	if doc, err := kmzDocKML(zr); err == nil {
+		queue = append(queue, path.Clean(doc.Name))
+	}
+	for _, f := range zr.File {
+		if strings.EqualFold(path.Ext(f.Name), ".kml") {
+			queue = append(queue, path.Clean(f.Name))
+		}
+	}
+	if len(queue) == 0 {
+		return nil, fmt.Errorf("No .kml file in the KMZ")
+	}
+	files := kmzFiles(zr)
+	seen := make(map[string]bool)
+	var overlays []*kmlGroundOverlay
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		f := files[name]
+		if seen[name] || f == nil {
+			continue
+		}
+		seen[name] = true
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		kos, links, err := readKML(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		dir := path.Dir(name)
+		for _, o := range kos {
+			o.Icon.Href = kmzHref(dir, o.Icon.Href)
+		}
+		overlays = append(overlays, kos...)
+		var next []string // loaded next, before the rest
+		for _, l := range links {
+			if h := kmzHref(dir, l); strings.EqualFold(path.Ext(h), ".kml") {
+				next = append(next, h)
+			}
+		}
+		queue = append(next, queue...)
+	}
+	return overlays, nil
+}
+
+// kmzHref returns the path from the KMZ's root of the href in a KML in
+// directory dir of the KMZ. URLs and absolute paths are left as is.
+func kmzHref(dir, href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.Contains(href, "://") || path.IsAbs(href) {
+		return href
+	}
+	return path.Join(dir, href)
+}
+
+// kmzDocKML returns the KML file in the given KMZ that devices and
+// apps read: /doc.kml if there is one, else the first .kml at its
+// root as Google Earth does.
+func kmzDocKML(zr *zip.Reader) (*zip.File, error) {
+	var first *zip.File
+	for _, f := range zr.File {
+		if path.Dir(f.Name) != "." || !strings.EqualFold(path.Ext(f.Name), ".kml") {
+			continue
+		}
+		if f.Name == "doc.kml" {
+			return f, nil
+		}
+		if first == nil {
+			first = f
+		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("No .kml file at the root of the KMZ")
+	}
+	return first, nil
+}
+
+// kmzFiles returns the files in the KMZ by their cleaned path, the
+// way GroundOverlay Icon hrefs refer to them
+func kmzFiles(zr *zip.Reader) map[string]*zip.File {
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[path.Clean(f.Name)] = f
+	}
+	return files
+}
+
+// readKMZOverlays returns the GroundOverlays of all the given KMZ's
+// KMLs as per readKMZAllOverlays, or of the given file if it is plain
+// .kml
+func readKMZOverlays(fpath string) ([]*kmlGroundOverlay, error) {
+	if strings.EqualFold(path.Ext(fpath), ".kml") {
+		f, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readKMLOverlays(f)
+	}
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening KMZ %v: %v", fpath, err)
+	}
+	defer zr.Close()
+	overlays, err := readKMZAllOverlays(&zr.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error with KMZ %v: %v", fpath, err)
+	}
+	return overlays, nil
+}
+
+// overlaysBox returns the north, south, east, west box enclosing all
+// the overlays' LatLonBoxes
+func overlaysBox(overlays []*kmlGroundOverlay) ([]float64, error) {
+	if len(overlays) == 0 {
+		return nil, fmt.Errorf("No GroundOverlays found")
+	}
+	var box []float64
+	var minLon, maxLon float64 // relative to first's west so crossing 180 works
+	for _, o := range overlays {
+		b, err := o.box()
+		if err != nil {
+			return nil, err
+		}
+		if box == nil {
+			box = []float64{b[north], b[south], b[east], b[west]}
+		}
+		box[north] = math.Max(box[north], b[north])
+		box[south] = math.Min(box[south], b[south])
+		w := normEasting(b[west] - box[west])
+		minLon, maxLon = math.Min(minLon, w), math.Max(maxLon, w+eastDelta(b[east], b[west]))
+	}
+	box[east] = normEasting(box[west] + maxLon)
+	box[west] = normEasting(box[west] + minLon)
+	return box, nil
+}
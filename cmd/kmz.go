@@ -1,64 +1,38 @@
 // cutkmz subcommands
 //
-// Other than root.go, each of these go files is a  cutkmz subcommand implementation
+// Other than root.go, each of these go files named after a subcommand
+// is its implementation. The rest hold the pieces they share, such as
+// the imaging backends in backend.go.
 //
-//   - kmz -    produces a KMZ with input JPG chopped into 1024x1024 tiles
+//   - kmz -    produces a KMZ with input JPG chopped into tiles of up to 1MP
 //   - bigkmz - produces a KMZ containing input JPG as is for higher resolution uses such as Google Earth
+//   - rename - renames an image to the name-geo-anchored form kmz and bigkmz expect
+//   - info -   reports on a KMZ's overlays and whether a Garmin can use it
+//   - unpack - re-assembles a KMZ's tiles into one name-geo-anchored JPG
+//   - convert - re-tiles another tool's KMZ or KML into one a Garmin can use
+//   - xyz -    produces a z/x/y directory of Web Mercator tiles for web maps and phone apps
+//   - mbtiles - produces an MBTiles file of Web Mercator tiles for offline phone apps (built with -tags mbtiles)
+//   - jnx -    produces a Garmin JNX (BirdsEye) raster map of up to 5 levels
 package cmd
 
 import (
 	"archive/zip"
-	"bytes"
 	"flag"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
 
 	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-const (
-	convProg     = "convert"  // img mgck. "gm convert" poss
-	identifyProg = "identify" // "gm identify" ditto
-)
-
-const kmlHdrTmpl = `<?xml version="1.0" encoding="UTF-8"?>
-<kml xmlns="http://www.opengis.net/kml/2.2">
-<Document>
-  <name>{{ .Name }}</name>
-`
-
-const kmlOverlayTmpl = `  <GroundOverlay>
-    <name>{{ .Name }}</name>
-    <color>bdffffff</color>
-    <drawOrder>{{ .DrawingOrder }} </drawOrder>
-    <Icon>
-      <href>{{ .TileFileName }}</href>
-      <viewBoundScale>1.0</viewBoundScale>
-    </Icon>
-    <LatLonBox>
-      <north>{{ .North }}</north>
-      <south>{{ .South }} </south>
-      <east>{{  .East  }}</east>
-      <west>{{  .West  }}</west>
-      <rotation>0.0</rotation>
-    </LatLonBox>
-  </GroundOverlay>
-`
-
-const kmlFtr = `</Document>
-</kml>
-`
-
 const (
 	north int = iota // index into [4]float64 assoc dec. degrees
 	south
@@ -93,8 +67,8 @@ func newMapTile(fpath string, pixWid, pixHigh int, n, s, e, w float64) *mapTile
 
 // NewMapTileFromFile reads in given file path and creates a map tile
 // with the filepath and pix width & height from the image.
-func newMapTileFromFile(fpath string, n, s, e, w float64) (*mapTile, error) {
-	wid, high, err := imageWxH(fpath)
+func newMapTileFromFile(ib ImageBackend, fpath string, n, s, e, w float64) (*mapTile, error) {
+	wid, high, err := ib.Identify(fpath)
 	if err != nil {
 		return nil, err
 	}
@@ -116,11 +90,109 @@ the jpg, cutkmz expects it to be encoded into the file's name,
 
 Underscores are required: <map-name>_<North-lat>_<South-lat>_<East-long>_<West-long>.<fmt>
 
+If the image has an ESRI world file next to it (e.g. mymap.jgw,
+mymap.tfw, mymap.pgw or mymap.wld for mymap.jpg) in decimal degrees,
+the bounding box is taken from it instead and the file can be named
+anything. Likewise for a lat/long GeoTIFF (.tif) with its
+georeferencing tags, e.g.
+
+    cutkmz kmz survey.tif
+
+Maps in a projected CRS such as UTM or BC Albers are reprojected to
+the lat/long grid KMZ overlays assume, otherwise tiles drift off by
+tens of metres towards the edges. GeoTIFFs say what CRS they are in;
+for world files give it with --src_crs, e.g. --src_crs 26910 for
+NAD83 UTM zone 10N. Supported are UTM zones (326zz & 327zz WGS84,
+269zz NAD83), 3857 Web Mercator, 3005 BC Albers and 5070 CONUS Albers.
+Reprojecting is done in memory whatever the --backend, taking about
+8 bytes per pixel of the map, e.g. 1.6GB for a 200MP scan.
+
+Scanned maps that are not north-up can be placed with --rotation,
+the degrees counter-clockwise to turn the box to fit the map (KML
+LatLonBox rotation), or with --corners giving the lat/long of the
+map's NW, NE, SE and SW corners (a gx:LatLonQuad). Not all GPS models
+support these; Google Earth does.
+
+Scans calibrated in OziExplorer are placed by their .map file instead,
+e.g. mymap.map for mymap.jpg, if there's no world file. Its
+calibration points and datum are used (WGS 84, NAD83, NAD27, European
+1950, OSGB, Tokyo and Pulkovo 1942), in Latitude/Longitude or UTM
+projection. A single map that is not north-up is placed by its
+corners, as with --corners.
+
+For volunteers using Ozi, --ozi_map also writes the KMZ's tiles to a
+directory next to it, e.g. mymap-ozi/ for mymap.kmz, each with a .map
+file calibrating it in WGS 84. Not for maps placed with --rotation;
+give --corners instead.
+
+Topo sheets usually have legends and margins outside the neat line.
+Crop them off with --crop_pixels giving the left,top,right,bottom
+pixels of the image to keep, or --crop_box giving the north,south,
+east,west decimal degrees of the map to keep, e.g.
+
+    cutkmz kmz --crop_box 49.45,49.35,-122.99,-123.12 Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+The bounding box is recomputed for the part kept, so the name-geo-
+anchored file name (or world file) stays that of the whole image.
+
 Garmin limits the max tiles per model (100 on 62s, 500 on Montana,
 Oregon 600 series and GPSMAP 64 series. Tiles of more than 1 megapixel
 (w*h) add no additional clarity. If you have a large image, it will be
 reduced in quality until it can be chopped in max-tiles or less
-1024x1024 chunks. 
+chunks. Tile shapes are chosen to cover the image in the fewest tiles
+of up to 1MP, e.g. 512x2048 or 1000x1048 as well as 1024x1024, rather
+than leave thin slivers along the right and bottom edges.
+
+Pick your model with --device so its limits are met, e.g. --device
+montana. Built in are gpsmap62, gpsmap64, montana, oregon600 etc.
+(see --device below), which differ only in max tiles: 100 for older
+models, the default, and 500 for newer ones. All take tiles of up to
+1MP and 3MB. Add your own, or change these, in the config file:
+
+    devices:
+      mygps:
+        max_tiles: 300
+        max_tile_pixels: 1048576
+        max_tile_bytes: 3145728
+        drawing_order: 60
+
+--max_tiles and --drawing_order override the device's.
+
+The tile limit is for all the custom maps on the device at once. To
+cut several maps that must fit together, use --share_tiles:
+
+    cutkmz kmz --device gpsmap62 --share_tiles a.jpg b.jpg c.jpg
+
+makes a.kmz, b.kmz & c.kmz with 100 tiles between them. Each image is
+reduced by the same amount, so larger ones get more tiles. Give some
+more detail than others with --priority, e.g. --priority 4,1,1 gives
+a.jpg about four times the pixels per area it would otherwise get.
+
+To put them all in one KMZ instead, e.g. the sector maps of a search,
+use --out:
+
+    cutkmz kmz --device gpsmap62 --out sectors.kmz a.jpg b.jpg c.jpg
+
+Each map is in its own folder of sectors.kmz's doc.kml, the tiles
+sharing the device's limit as with --share_tiles. Later maps are
+drawn on top of earlier ones, with drawOrder 51, 52, 53 etc.
+
+Scanned maps often have white margins or collars which would use up
+tiles. With --skip_blank, tiles of a single colour (give or take
+--blank_tolerance for scanner noise) are left out of the KMZ, and the
+tiles saved are spent on higher resolution for the rest of the map.
+
+Overlays are 74% opaque by default. Change that with --opacity, from
+0 to 1, and tint them with --tint, e.g. --opacity 1 --tint ffd0d0 for
+opaque and pinkish. These, and the drawOrder, can be given per map
+in the config file, by map name:
+
+    opacity: 0.9
+    maps:
+      Grouse-Mountain:
+        opacity: 1
+        tint: ffe0e0
+        drawing_order: 60
 
 Connect your GPS via USB and copy the generated kmz files into /Garmin/CustomMap (SD or main mem).
 
@@ -128,14 +200,19 @@ Garmin limitations on .kmz files and the images in them:
   * image must be jpeg, not 'progressive'
   * only considers the /doc.kml in the .kmz
   * tiles over 1MP, e.g. > 1024x1024 or 512x2048 etc pixels do not add increased resolution
-  * each tile jpeg should be less than 3MB.
+  * each tile jpeg should be less than 3MB. Larger tiles are re-encoded
+    at the highest JPEG quality that fits.
   * Max images/tiles per device: typically 100. 500 on some.
   * smaller image files are rendered faster
 
-Requires the imagemagick to be installed on your system, and uses its
-"convert" and "identify" programs
+The image work is done by the first of ImageMagick ("convert" and
+"identify"), GraphicsMagick ("gm") or libvips ("vips" and
+"vipsheader") found on your PATH, or in-process if none are
+installed. Choose one with --backend magick|gm|vips|go or a "backend"
+key in your config file.
 
 `,
+	PreRun: bindFlags,
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := process(viper.GetViper(), args); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -151,15 +228,57 @@ func init() {
 	kmzCmd.Flags().StringP("image", "i", "", "image file named with its bounding box in decimal degrees.")
 	viper.BindPFlag("image", kmzCmd.Flags().Lookup("image"))
 
-	kmzCmd.Flags().IntP("max_tiles", "t", 100, "max # pieces to cut jpg into. Beware of device limits.")
+	kmzCmd.Flags().String("device", defaultDevice, "GPS model whose limits to meet: "+deviceNames()+", or one from the config file.")
+	viper.BindPFlag("device", kmzCmd.Flags().Lookup("device"))
+
+	kmzCmd.Flags().IntP("max_tiles", "t", 0, "max # pieces to cut jpg into. 0 means the device's limit.")
 	viper.BindPFlag("max_tiles", kmzCmd.Flags().Lookup("max_tiles"))
 
-	kmzCmd.Flags().IntP("drawing_order", "d", 51, "Garmins make values > 50 visible. Tune if have overlapping overlays.")
+	kmzCmd.Flags().BoolP("share_tiles", "s", false, "Share max_tiles across all the images instead of each getting max_tiles.")
+	viper.BindPFlag("share_tiles", kmzCmd.Flags().Lookup("share_tiles"))
+
+	kmzCmd.Flags().StringP("out", "o", "", "Put all the images in this one KMZ, each map in its own folder, sharing max_tiles.")
+	viper.BindPFlag("out", kmzCmd.Flags().Lookup("out"))
+
+	kmzCmd.Flags().String("priority", "", "With --share_tiles or --out, comma separated weights, one per image in order, e.g. 2,1,1 gives the first twice the detail per area.")
+	viper.BindPFlag("priority", kmzCmd.Flags().Lookup("priority"))
+
+	kmzCmd.Flags().Bool("skip_blank", false, "Drop tiles of a single colour, e.g. white margins, and spend the tiles saved on more detail for the rest.")
+	viper.BindPFlag("skip_blank", kmzCmd.Flags().Lookup("skip_blank"))
+
+	kmzCmd.Flags().Int("blank_tolerance", defaultBlankTolerance, "With --skip_blank, how much a tile's colours may vary, 0-255 per channel, and still be blank.")
+	viper.BindPFlag("blank_tolerance", kmzCmd.Flags().Lookup("blank_tolerance"))
+
+	kmzCmd.Flags().IntP("drawing_order", "d", 0, "Garmins make values > 50 visible. Tune if have overlapping overlays. 0 means the device's default, usually 51.")
 	viper.BindPFlag("drawing_order", kmzCmd.Flags().Lookup("drawing_order"))
 
+	kmzCmd.Flags().Float64("opacity", defaultOpacity, "Overlay opacity, from 0 (invisible) to 1 (opaque).")
+	viper.BindPFlag("opacity", kmzCmd.Flags().Lookup("opacity"))
+
+	kmzCmd.Flags().String("tint", defaultTint, "Overlay tint as rrggbb hex. ffffff leaves the map's colours as they are.")
+	viper.BindPFlag("tint", kmzCmd.Flags().Lookup("tint"))
+
 	kmzCmd.Flags().BoolP("keep_tmp", "k", false, "Don't delete intermediate files from $TMPDIR.")
 	viper.BindPFlag("keep_tmp", kmzCmd.Flags().Lookup("keep_tmp"))
 
+	kmzCmd.Flags().Bool("ozi_map", false, "Also write the KMZ's tiles to a directory next to it, each with an OziExplorer .map file.")
+	viper.BindPFlag("ozi_map", kmzCmd.Flags().Lookup("ozi_map"))
+
+	kmzCmd.Flags().Int("src_crs", 0, "EPSG code of a projected world file or GeoTIFF, e.g. 32610 for UTM zone 10N. Reprojects to lat/long.")
+	viper.BindPFlag("src_crs", kmzCmd.Flags().Lookup("src_crs"))
+
+	kmzCmd.Flags().Float64("rotation", 0, "Degrees counter-clockwise the map's box is rotated about its centre to fit the map.")
+	viper.BindPFlag("rotation", kmzCmd.Flags().Lookup("rotation"))
+
+	kmzCmd.Flags().String("corners", "", "Map corners lat,long in NW,NE,SE,SW order instead of a box, for maps not north-up. 8 comma separated decimal degrees.")
+	viper.BindPFlag("corners", kmzCmd.Flags().Lookup("corners"))
+
+	kmzCmd.Flags().String("crop_pixels", "", "Crop the map's collar off: left,top,right,bottom pixels of the image to keep.")
+	viper.BindPFlag("crop_pixels", kmzCmd.Flags().Lookup("crop_pixels"))
+
+	kmzCmd.Flags().String("crop_box", "", "Crop the map's collar off: north,south,east,west decimal degrees of the map to keep.")
+	viper.BindPFlag("crop_box", kmzCmd.Flags().Lookup("crop_box"))
+
 	kmzCmd.Flags().AddGoFlagSet(flag.CommandLine)
 	flag.CommandLine.VisitAll(func(f *flag.Flag) {
 		viper.BindPFlag(f.Name, kmzCmd.Flags().Lookup(f.Name))
@@ -167,16 +286,16 @@ func init() {
 	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
 }
 
-//  getBox returns map name & lat/long bounding box by extracing it
-//  from the given file name. The Float slice is in order: northLat,
-//  southLat, eastLong, westLong in decimal degrees
+// getBox returns map name & lat/long bounding box by extracing it
+// from the given file name. The Float slice is in order: northLat,
+// southLat, eastLong, westLong in decimal degrees
 func getBox(image string) (base string, box []float64, err error) {
-	c := strings.Split(image, "_")
+	c := strings.Split(filepath.Base(image), "_")
 	if len(c) != 5 {
 		err = fmt.Errorf("File name must include bounding box name_N_S_E_W.jpg in decimal degrees, e.g. Grouse-Mountain_49.336694_49.470628_-123.132056_-122.9811.jpg")
 		return
 	}
-	base = filepath.Base(c[0])
+	base = c[0]
 	for i := 1; i < 5; i++ {
 		if i == 4 {
 			s := strings.SplitN(c[i], ".", 3)
@@ -192,53 +311,222 @@ func getBox(image string) (base string, box []float64, err error) {
 		box = append(box, f)
 	}
 
+	return base, box, checkBox(box)
+}
+
+// checkBox returns an error if the given north, south, east, west
+// decimal degrees bounding box is unusable
+func checkBox(box []float64) error {
 	if box[north] <= box[south] || box[north] > 90 || box[south] < -90 {
-		return base, box, fmt.Errorf("North boundary must be greater than south boundary and in [-90,90]")
+		return fmt.Errorf("North boundary must be greater than south boundary and in [-90,90]")
 	}
-	return
+	return nil
 }
 
-// imageWxH returns the width and height of image file in pixels
-func imageWxH(imageFilename string) (width int, height int, err error) {
-	if _, err := os.Stat(imageFilename); os.IsNotExist(err) {
-		return 0, 0, err
+// mapBox returns the map name & bounding box of the given image. The
+// box comes from the image's GeoTIFF tags if it is a GeoTIFF, or its
+// world file if it has one (e.g. mymap.jgw for mymap.jpg), or its
+// OziExplorer .map file if it has one (e.g. mymap.map), otherwise from
+// its name-geo-anchored file name as per getBox.
+//
+// The box is in lat/long decimal degrees unless the returned crs is
+// non-zero, in which case it is in that projected CRS's units. A
+// non-zero srcCRS EPSG code says what CRS a world file or GeoTIFF is
+// in, overriding any in the GeoTIFF's tags.
+func mapBox(ib ImageBackend, image string, srcCRS int) (base string, box []float64, crs int, err error) {
+	if isLatLongCRS(srcCRS) {
+		srcCRS = 0
 	}
-	cmd := exec.Command(identifyProg, "-format", "%w %h", imageFilename)
-	glog.Infof("About to run: %#v\n", cmd.Args)
-	var b []byte
-	b, err = cmd.Output()
-	if err != nil {
-		return 0, 0, err
+	base = strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+	if ext := strings.ToLower(filepath.Ext(image)); ext == ".tif" || ext == ".tiff" {
+		gt, gerr := readGeoTIFF(image)
+		if gerr == nil {
+			box, crs, err = geoTIFFBox(image, gt, srcCRS)
+			return
+		}
+		glog.Infof("Not using GeoTIFF tags: %v\n", gerr)
 	}
-	wh := bytes.Split(b, []byte(" "))
-	if len(wh) != 2 {
-		return 0, 0, fmt.Errorf("Expected two ints separated by space, but got: %v", b)
+	wfPath := findWorldFile(image)
+	if wfPath == "" {
+		if omPath := findOziMap(image); omPath != "" {
+			return oziMapBox(ib, image, omPath, srcCRS)
+		}
+		if srcCRS != 0 {
+			return "", nil, 0, fmt.Errorf("A source CRS needs a world file or GeoTIFF, name-geo-anchored file names must be in lat/long")
+		}
+		base, box, err = getBox(image)
+		return
 	}
-	width, err = strconv.Atoi(string(wh[0]))
+	wf, err := readWorldFile(wfPath)
 	if err != nil {
 		return
 	}
-	height, err = strconv.Atoi(string(wh[1]))
+	wid, high, err := ib.Identify(image)
 	if err != nil {
 		return
 	}
+	if box, err = wf.box(wid, high); err != nil {
+		return "", nil, 0, fmt.Errorf("Error with world file %v: %v", wfPath, err)
+	}
+	if srcCRS != 0 {
+		return base, box, srcCRS, checkProjectedBox(box)
+	}
+	if err = checkBox(box); err != nil {
+		return "", nil, 0, fmt.Errorf("World file %v must be in decimal degrees (WGS84) or have its CRS given: %v", wfPath, err)
+	}
 	return
 }
 
+// cornersFlag returns the map corners given by the "corners" viper
+// key, if any, else those of a single image's OziExplorer .map file if
+// it isn't north-up. They only make sense for a single image and not
+// with a rotation.
+func cornersFlag(v *viper.Viper, ib ImageBackend, rotation float64, args []string) (quad [4][2]float64, hasQuad bool, err error) {
+	if rotation < -180 || rotation > 180 {
+		return quad, false, fmt.Errorf("Rotation must be in [-180,180] degrees, got %v", rotation)
+	}
+	corners := v.GetString("corners")
+	if corners == "" {
+		if len(args) == 1 {
+			return oziCorners(ib, args[0], v.GetInt("src_crs"), rotation)
+		}
+		return quad, false, nil
+	}
+	if len(args) != 1 {
+		return quad, false, fmt.Errorf("Corners can only be given for one image at a time")
+	}
+	if rotation != 0 {
+		return quad, false, fmt.Errorf("Give either corners or a rotation, not both")
+	}
+	quad, err = parseCorners(corners)
+	return quad, err == nil, err
+}
+
+// parsePriorities parses the comma separated --priority weights, one
+// for each of n images. Nil if s is empty.
+func parsePriorities(s string, n int) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	c := strings.Split(s, ",")
+	if len(c) != n {
+		return nil, fmt.Errorf("Priority must have a weight for each of the %d images, got %q", n, s)
+	}
+	var weights []float64
+	for _, v := range c {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing priority: %v", err)
+		}
+		if f <= 0 {
+			return nil, fmt.Errorf("Priorities must be more than 0, got %v", f)
+		}
+		weights = append(weights, f)
+	}
+	return weights, nil
+}
+
+// quadOrMapBox returns the image's name and the box enclosing the
+// given quad corners if hasQuad, otherwise what mapBox does
+func quadOrMapBox(ib ImageBackend, image string, srcCRS int, quad [4][2]float64, hasQuad bool) (base string, box []float64, crs int, err error) {
+	if !hasQuad {
+		return mapBox(ib, image, srcCRS)
+	}
+	if base, _, err = getBox(image); err != nil {
+		base = strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+	}
+	return base, quadBox(quad), 0, nil
+}
+
+// geoTIFFBox returns the bounding box of the given GeoTIFF image using
+// its tags, and the EPSG code of its CRS if projected. A non-zero
+// srcCRS overrides the tags' CRS.
+func geoTIFFBox(image string, gt *geoTIFF, srcCRS int) (box []float64, crs int, err error) {
+	box = gt.box()
+	glog.Infof("GeoTIFF %v CRS EPSG:%d geographic: %v box %v\n", image, gt.crs, gt.geographic, box)
+	if srcCRS != 0 {
+		return box, srcCRS, checkProjectedBox(box)
+	}
+	if !gt.geographic {
+		if gt.crs == 0 {
+			return nil, 0, fmt.Errorf("GeoTIFF %v is in a user defined projected CRS, give its EPSG code", image)
+		}
+		return box, gt.crs, checkProjectedBox(box)
+	}
+	if err = checkBox(box); err != nil {
+		return nil, 0, fmt.Errorf("Error with GeoTIFF %v bounding box: %v", image, err)
+	}
+	return box, 0, nil
+}
+
+// checkProjectedBox returns an error if the given north, south, east,
+// west box in projected CRS units is upside down or backwards
+func checkProjectedBox(box []float64) error {
+	if box[north] <= box[south] || box[east] <= box[west] {
+		return fmt.Errorf("Projected map's north must be greater than south and east greater than west, got %v", box)
+	}
+	return nil
+}
+
 // process the name-geo-anchored files args into KMZs. Uses
-// "max_tiles" and and "drawing_order" from viper if present.
+// "max_tiles", "drawing_order", "backend", "src_crs", "skip_blank",
+// "blank_tolerance", "opacity", "tint", "out" and "ozi_map" from viper
+// if present.
 func process(v *viper.Viper, args []string) error {
-	maxTiles := v.GetInt("max_tiles")
-	drawingOrder := v.GetInt("drawing_order")
 	keepTmp := v.GetBool("keep_tmp")
+	srcCRS := v.GetInt("src_crs")
+	rotation := v.GetFloat64("rotation")
+	shareTiles := v.GetBool("share_tiles")
+	out := v.GetString("out")
+	skipBlank := v.GetBool("skip_blank")
+	blankTolerance := v.GetInt("blank_tolerance")
+	oziMap := v.GetBool("ozi_map")
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
+	dev, err := deviceFromFlags(v)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("maxTiles %v, drawingOrder: %v, keepTmp: %v\n", maxTiles, drawingOrder, keepTmp)
+	fmt.Printf("device: %v, keepTmp: %v, backend: %v, srcCRS: %v, rotation: %v, shareTiles: %v, skipBlank: %v, out: %v\n", dev, keepTmp, ib, srcCRS, rotation, shareTiles, skipBlank, out)
 
 	if len(args) == 0 {
 		return fmt.Errorf("Image file required: must provide one or more imaage file path")
 	}
+	if blankTolerance < 0 || blankTolerance > 255 {
+		return fmt.Errorf("Blank tolerance must be in [0,255], got %d", blankTolerance)
+	}
+	priorities, err := parsePriorities(v.GetString("priority"), len(args))
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		shareTiles = true // one KMZ has one budget
+		if !strings.EqualFold(filepath.Ext(out), ".kmz") {
+			out += ".kmz"
+		}
+	}
+	if priorities != nil && !shareTiles {
+		return fmt.Errorf("--priority only applies with --share_tiles or --out")
+	}
+	if oziMap && rotation != 0 {
+		return fmt.Errorf("OziExplorer .map files can't be written for maps placed with a rotation, give --corners instead")
+	}
+	quad, hasQuad, err := cornersFlag(v, ib, rotation, args)
+	if err != nil {
+		return err
+	}
+	crop, err := cropFlags(v, rotation, hasQuad, args)
+	if err != nil {
+		return err
+	}
 
-	for _, image := range args {
+	// size up every image first so a shared tile budget can be split
+	jobs := make([]*tileJob, len(args))
+	tmpDirs := make([]string, len(args))
+	for i, image := range args {
 		if _, err := os.Stat(image); os.IsNotExist(err) {
 			return err
 		}
@@ -246,148 +534,466 @@ func process(v *viper.Viper, args []string) error {
 		if err != nil {
 			return fmt.Errorf("Issue with an image file path: %v", err)
 		}
-		base, box, err := getBox(absImage)
+		base, box, crs, err := quadOrMapBox(ib, absImage, srcCRS, quad, hasQuad)
 		if err != nil {
-			return fmt.Errorf("Error with image file name: %v", err)
+			return fmt.Errorf("Error with image bounding box: %v", err)
 		}
-		origMap, err := newMapTileFromFile(absImage, box[north], box[south], box[east], box[west])
-		if err != nil {
-			return fmt.Errorf("Error extracting image dimensions: %v", err)
-		}
-		maxPixels := maxTiles * 1024 * 1024
 		tmpDir, err := ioutil.TempDir("", "cutkmz-")
 		if err != nil {
 			return fmt.Errorf("Error creating a temporary directory: %v", err)
 		}
-		tilesDir := filepath.Join(tmpDir, base, "tiles")
-		err = os.MkdirAll(tilesDir, 0755)
-		if err != nil {
-			return fmt.Errorf("Error making tiles dir in tmp dir: %v", err)
+		tmpDirs[i] = tmpDir
+		if absImage, box, err = crop.cropPixels(ib, tmpDir, absImage, box, crs == 0); err != nil {
+			return fmt.Errorf("Error cropping image: %v", err)
 		}
-
-		fixedJpg := filepath.Join(tmpDir, "fixed.jpg")
-		if maxPixels < (origMap.height * origMap.width) {
-			resizeFixToJpg(fixedJpg, absImage, maxPixels)
-		} else {
-			fixToJpg(fixedJpg, absImage)
+		if crs != 0 {
+			warped := filepath.Join(tmpDir, "warped.jpg")
+			if box, err = warpToLatLong(warped, absImage, box, crs); err != nil {
+				return fmt.Errorf("Error reprojecting image to lat/long: %v", err)
+			}
+			absImage = warped
 		}
-
-		// Need to know pixel width of map from which we
-		// chopped the tiles so we know which row a tile is
-		// in. Knowing the tile's row allows us to set its
-		// bounding box correctly.
-		fixedMap, err := newMapTileFromFile(fixedJpg, box[north], box[south], box[east], box[west])
+		if absImage, box, err = crop.cropBox(ib, tmpDir, absImage, box); err != nil {
+			return fmt.Errorf("Error cropping image: %v", err)
+		}
+		origMap, err := newMapTileFromFile(ib, absImage, box[north], box[south], box[east], box[west])
 		if err != nil {
-			return err
+			return fmt.Errorf("Error extracting image dimensions: %v", err)
 		}
-
-		// chop chop chop. bork. bork bork.
-		chopToJpgs(fixedJpg, tilesDir, base)
-
-		var kdocWtr *os.File
-
-		if kdocWtr, err = os.Create(filepath.Join(tmpDir, base, "doc.kml")); err != nil {
+		color, err := mapColor(v, base)
+		if err != nil {
 			return err
 		}
-		if err = startKML(kdocWtr, base); err != nil {
+		drawingOrder := mapDrawingOrder(v, base, 0)
+		if out != "" {
+			// later maps on top, each in its own folder & tiles dir
+			drawingOrder = mapDrawingOrder(v, base, dev.drawingOrder+i)
+			base = uniqueBase(jobs[:i], base)
+		}
+		jobs[i] = &tileJob{
+			image:          absImage,
+			width:          origMap.width,
+			height:         origMap.height,
+			base:           base,
+			box:            box,
+			quad:           quad,
+			hasQuad:        hasQuad,
+			rotation:       rotation,
+			dev:            dev,
+			skipBlank:      skipBlank,
+			blankTolerance: blankTolerance,
+			color:          color,
+			drawingOrder:   drawingOrder,
+		}
+	}
+	if shareTiles {
+		sizes := make([]image.Point, len(jobs))
+		for i, tj := range jobs {
+			sizes[i] = image.Pt(tj.width, tj.height)
+		}
+		budget, err := tileBudget(sizes, priorities, dev.maxTiles, dev.maxTilePixels)
+		if err != nil {
 			return err
 		}
+		for i, tj := range jobs {
+			tj.maxPixels = budget[i]
+		}
+	} else {
+		for _, tj := range jobs {
+			if tj.maxPixels, err = imageTileBudget(tj.width, tj.height, dev.maxTiles, dev.maxTilePixels); err != nil {
+				return err
+			}
+		}
+	}
 
-		// For each jpg tile create an entry in the kml file
-		// with its bounding box. Imagemagick crop+adjoin
-		// chopped & numbered the tile image files
-		// lexocographically ascending starting from top left
-		// (000) (NW) eastwards & then down to bottom right
-		// (SE). ReadDir gives sorted result.
-		var tileFiles []os.FileInfo
-		if tileFiles, err = ioutil.ReadDir(tilesDir); err != nil {
+	var outDir string // the combined KMZ's root
+	if out != "" {
+		if outDir, err = ioutil.TempDir("", "cutkmz-"); err != nil {
+			return fmt.Errorf("Error creating a temporary directory: %v", err)
+		}
+	}
+	for i, tj := range jobs {
+		tj.tmpDir = tmpDirs[i]
+		tj.kmzDir = filepath.Join(tj.tmpDir, tj.base)
+		tj.tilesDir = filepath.Join(tj.kmzDir, "tiles")
+		if out != "" {
+			tj.kmzDir = outDir
+			tj.tilesDir = filepath.Join(outDir, "tiles", tj.base)
+		}
+		if err = os.MkdirAll(tj.tilesDir, 0755); err != nil {
+			return fmt.Errorf("Error making tiles dir in tmp dir: %v", err)
+		}
+	}
+	var overlays [][]*kmlOverlay
+	if shareTiles {
+		if overlays, err = chopAll(ib, jobs, dev.maxTiles); err != nil {
 			return err
 		}
-		var widthSum int
-		currNorth := fixedMap.box[north]
-		currWest := fixedMap.box[west]
-		for _, tf := range tileFiles {
-
-			tile, err := newMapTileFromFile(filepath.Join(tilesDir, tf.Name()), currNorth, 0, 0, currWest)
+	} else {
+		for _, tj := range jobs {
+			o, err := chopAll(ib, []*tileJob{tj}, dev.maxTiles)
 			if err != nil {
 				return err
 			}
-			// righmost tiles might be narrower, bottom
-			// ones shorter so must re-compute S & E edge
-			// for each tile; cannot assume all same
-			// size. Also double checks assumption that
-			// chopping preserves number of pixels
-			finishTileBox(tile, fixedMap)
+			overlays = append(overlays, o...)
+		}
+	}
 
-			var relTPath string // file ref inside KML must be relative to kmz root
-			if relTPath, err = filepath.Rel(filepath.Join(tmpDir, base), tile.fpath); err != nil {
-				return err
+	if out != "" {
+		if err = writeCombinedKMZ(out, outDir, jobs, overlays); err != nil {
+			return err
+		}
+		tmpDirs = append(tmpDirs, outDir)
+	}
+	total := 0
+	for i, tj := range jobs {
+		if oziMap {
+			oziDir := tj.base + "-ozi"
+			if out != "" {
+				oziDir = strings.TrimSuffix(out, filepath.Ext(out)) + "-ozi"
 			}
-			if err = kmlAddOverlay(kdocWtr, tf.Name(), tile.box, drawingOrder, relTPath); err != nil {
+			if err = tj.writeOziTiles(oziDir); err != nil {
+				return fmt.Errorf("Error writing OziExplorer tiles: %v", err)
+			}
+			fmt.Printf("%v: %d tiles with OziExplorer .map files\n", oziDir, len(tj.tiles))
+		}
+		if out == "" {
+			if err = writeKMZ(tj.base+".kmz", tj.kmzDir, &kmlDocument{Name: tj.base, Overlays: overlays[i]}); err != nil {
 				return err
 			}
-			widthSum += tile.width
-			if widthSum >= fixedMap.width {
-				// drop down a row
-				currNorth = tile.box[south]
-				currWest = fixedMap.box[west]
-				widthSum = 0
-			} else {
-				currWest = tile.box[east]
+			fmt.Printf("%v.kmz: %d tiles\n", tj.base, len(overlays[i]))
+		} else {
+			fmt.Printf("%v in %v: %d tiles\n", tj.base, out, len(overlays[i]))
+		}
+		total += len(overlays[i])
+	}
+	if !keepTmp {
+		for _, tmpDir := range tmpDirs {
+			if err = os.RemoveAll(tmpDir); err != nil {
+				return fmt.Errorf("Error removing tmp dir & contents: %v", err)
 			}
 		}
-		endKML(kdocWtr)
+	}
+	if len(jobs) > 1 {
+		fmt.Printf("%d tiles in all, device %v allows %d\n", total, dev.name, dev.maxTiles)
+	}
+	return nil
+}
+
+// writeKMZ writes doc as the doc.kml of kmzDir and zips kmzDir into
+// the KMZ file kmz
+func writeKMZ(kmz, kmzDir string, doc *kmlDocument) error {
+	kdocWtr, err := os.Create(filepath.Join(kmzDir, "doc.kml"))
+	if err != nil {
+		return err
+	}
+	if err = writeKML(kdocWtr, doc); err != nil {
 		kdocWtr.Close()
-		var zf *os.File
-		if zf, err = os.Create(base + ".kmz"); err != nil {
-			return err
-		}
-		zipd(filepath.Join(tmpDir, base), zf)
-		zf.Close()
+		return err
+	}
+	if err = kdocWtr.Close(); err != nil {
+		return err
+	}
+	zf, err := os.Create(kmz)
+	if err != nil {
+		return err
+	}
+	err = zipd(kmzDir, zf)
+	if cerr := zf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(kmz) // not leave a truncated KMZ
+		return fmt.Errorf("Error writing KMZ %v: %v", kmz, err)
+	}
+	return nil
+}
+
+// writeCombinedKMZ writes the KMZ file kmz with the jobs' tiles, all
+// in outDir, and a doc.kml with a Folder of GroundOverlays for each
+// job
+func writeCombinedKMZ(kmz, outDir string, jobs []*tileJob, overlays [][]*kmlOverlay) error {
+	doc := &kmlDocument{Name: strings.TrimSuffix(filepath.Base(kmz), filepath.Ext(kmz))}
+	for i, tj := range jobs {
+		doc.Folders = append(doc.Folders, &kmlFolder{Name: tj.base, Overlays: overlays[i]})
+	}
+	return writeKMZ(kmz, outDir, doc)
+}
+
+// uniqueBase returns base, with a -2, -3 etc. suffix if need be to
+// differ from the bases of the given jobs
+func uniqueBase(jobs []*tileJob, base string) string {
+	taken := make(map[string]bool)
+	for _, tj := range jobs {
+		taken[tj.base] = true
+	}
+	b := base
+	for n := 2; taken[b]; n++ {
+		b = fmt.Sprintf("%s-%d", base, n)
+	}
+	return b
+}
+
+// mapDrawingOrder returns the "drawing_order" under "maps.<name>" in
+// the config file if given, otherwise def
+func mapDrawingOrder(v *viper.Viper, name string, def int) int {
+	if key := "maps." + strings.ToLower(name) + ".drawing_order"; v.IsSet(key) {
+		return v.GetInt(key)
+	}
+	return def
+}
+
+// tileJob is a lat/long image to chop into tiles for a KMZ
+type tileJob struct {
+	image          string        // abs path of the image
+	width, height  int           // of the image in pixels
+	base           string        // tile file name prefix
+	box            []float64     // north, south, east, west
+	quad           [4][2]float64 // corners to place it by instead, if hasQuad
+	hasQuad        bool
+	rotation       float64      // LatLonBox rotation, if not hasQuad
+	maxPixels      int          // image is reduced to fit
+	dev            *device      // tile size & drawOrder
+	drawingOrder   int          // if not 0, instead of dev's
+	color          string       // KML aabbggrr, if not "" instead of the default
+	skipBlank      bool         // drop tiles of a single colour
+	blankTolerance int          // 0-255 spread of a single colour tile
+	tmpDir         string       // for intermediate files
+	kmzDir         string       // root of the KMZ, tile paths are relative to it
+	tilesDir       string       // where tiles are written
+	tiles          []placedTile // of the overlays of the last cut
+}
+
+// placedTile is a tile image and the lat/long of its NW, NE, SE & SW
+// corners
+type placedTile struct {
+	fpath         string
+	width, height int
+	quad          [4][2]float64
+}
+
+// cut resizes the job's image to its maxPixels, chops it into tiles
+// in its tilesDir and returns a GroundOverlay for each. Blank tiles
+// are dropped if skipBlank.
+func (tj *tileJob) cut(ib ImageBackend) ([]*kmlOverlay, error) {
+	var err error
+	box := tj.box
+	fixedJpg := filepath.Join(tj.tmpDir, tj.base+"-fixed.jpg")
+	if tj.maxPixels < tj.height*tj.width {
+		err = ib.Resize(fixedJpg, tj.image, tj.maxPixels)
+	} else {
+		err = ib.Normalize(fixedJpg, tj.image)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error converting image: %v", err)
+	}
 
-		if !keepTmp {
-			err = os.RemoveAll(tmpDir)
+	// Need to know pixel width of map from which we
+	// chopped the tiles so we know which row a tile is
+	// in. Knowing the tile's row allows us to set its
+	// bounding box correctly.
+	fixedMap, err := newMapTileFromFile(ib, fixedJpg, box[north], box[south], box[east], box[west])
+	if err != nil {
+		return nil, err
+	}
+
+	// chop chop chop. bork. bork bork.
+	if err = removeTiles(tj.tilesDir, tj.base); err != nil {
+		return nil, fmt.Errorf("Error removing old tiles: %v", err)
+	}
+	tl := planTiles(fixedMap.width, fixedMap.height, tj.dev.maxTilePixels)
+	glog.Infof("Cutting %v into %dx%d tiles of %dx%d\n", fixedJpg, tl.cols, tl.rows, tl.width, tl.height)
+	if err = ib.Crop(fixedJpg, tj.tilesDir, tj.base, tl); err != nil {
+		return nil, fmt.Errorf("Error chopping image into tiles: %v", err)
+	}
+
+	// For each jpg tile create an entry in the kml file
+	// with its bounding box. Tiles are numbered from top
+	// left (000) (NW) eastwards & then down to bottom
+	// right (SE).
+	drawingOrder := tj.dev.drawingOrder
+	if tj.drawingOrder != 0 {
+		drawingOrder = tj.drawingOrder
+	}
+	color := tj.color
+	if color == "" {
+		color, _ = kmlColor(defaultOpacity, defaultTint)
+	}
+	var widthSum, heightSum int // pixels left of & above tile
+	currNorth := fixedMap.box[north]
+	currWest := fixedMap.box[west]
+	var overlays []*kmlOverlay
+	tj.tiles = nil
+	for n := 0; n < tl.tiles(); n++ {
+		tpath := tileFile(tj.tilesDir, tj.base, n)
+		tf, err := os.Stat(tpath)
+		if err != nil {
+			return nil, fmt.Errorf("Chopped fewer tiles than the %dx%d planned: %v", tl.cols, tl.rows, err)
+		}
+		blank := false
+		if tj.skipBlank {
+			if blank, err = blankTile(tpath, tj.blankTolerance); err != nil {
+				return nil, err
+			}
+		}
+		if blank {
+			glog.Infof("Dropping blank tile %v\n", tf.Name())
+			if err = os.Remove(tpath); err != nil {
+				return nil, err
+			}
+		} else if tf.Size() > tj.dev.maxTileBytes {
+			q, size, err := fitJpg(tpath, tj.dev.maxTileBytes)
 			if err != nil {
-				return fmt.Errorf("Error removing tmp dir & contents: %v", err)
+				return nil, fmt.Errorf("Error fitting tile %v to %d bytes: %v", tf.Name(), tj.dev.maxTileBytes, err)
 			}
+			fmt.Printf("%v was %d bytes, re-encoded at quality %d to %d bytes\n", tf.Name(), tf.Size(), q, size)
 		}
+		r := tl.tileRect(n, image.Rect(0, 0, fixedMap.width, fixedMap.height))
+		tile := newMapTile(tpath, r.Dx(), r.Dy(), currNorth, 0, 0, currWest)
+		// righmost tiles might be narrower, bottom
+		// ones shorter so must re-compute S & E edge
+		// for each tile; cannot assume all same
+		// size.
+		finishTileBox(tile, fixedMap)
 
+		if !blank {
+			var relTPath string // file ref inside KML must be relative to kmz root
+			if relTPath, err = filepath.Rel(tj.kmzDir, tile.fpath); err != nil {
+				return nil, err
+			}
+			tquad := boxQuad(tile.box[:])
+			if tj.hasQuad {
+				fw, fh := float64(fixedMap.width), float64(fixedMap.height)
+				tquad = subQuad(tj.quad, float64(widthSum)/fw, float64(heightSum)/fh,
+					float64(widthSum+tile.width)/fw, float64(heightSum+tile.height)/fh)
+				overlays = append(overlays, newKMLQuadOverlay(tf.Name(), tquad, drawingOrder, color, relTPath))
+			} else {
+				overlays = append(overlays, newKMLOverlay(tf.Name(), rotateTileBox(tile.box, fixedMap.box, tj.rotation), tj.rotation, drawingOrder, color, relTPath))
+			}
+			tj.tiles = append(tj.tiles, placedTile{tile.fpath, tile.width, tile.height, tquad})
+		}
+		widthSum += tile.width
+		if widthSum >= fixedMap.width {
+			// drop down a row
+			currNorth = tile.box[south]
+			currWest = fixedMap.box[west]
+			widthSum = 0
+			heightSum += tile.height
+		} else {
+			currWest = tile.box[east]
+		}
 	}
-	return nil
+	if _, err = os.Stat(tileFile(tj.tilesDir, tj.base, tl.tiles())); err == nil {
+		return nil, fmt.Errorf("Chopped more tiles than the %dx%d planned", tl.cols, tl.rows)
+	}
+	if n := tl.tiles(); len(overlays) < n {
+		glog.Infof("%v: dropped %d blank tiles of %d\n", tj.base, n-len(overlays), n)
+	}
+	return overlays, nil
 }
 
-func startKML(w io.Writer, name string) error {
-	t, err := template.New("kmlhdr").Parse(kmlHdrTmpl)
+// removeTiles removes the tiles of the given base name from tilesDir,
+// left by an earlier cut
+func removeTiles(tilesDir, base string) error {
+	old, err := filepath.Glob(filepath.Join(tilesDir, base+"_tile_*"))
 	if err != nil {
 		return err
 	}
-	root := struct{ Name string }{name}
-	return t.Execute(w, &root)
+	for _, f := range old {
+		if err = os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func kmlAddOverlay(w io.Writer, tileName string, tbox [4]float64, drawingOrder int, relTileFile string) error {
-	t, err := template.New("kmloverlay").Parse(kmlOverlayTmpl)
-	if err != nil {
+// writeOziTiles copies the tiles of the job's last cut to dir, each
+// with an OziExplorer .map file. Corners are only right for tiles of
+// maps not placed with a rotation.
+func (tj *tileJob) writeOziTiles(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	root := struct {
-		Name         string
-		TileFileName string
-		DrawingOrder int
-		North        float64
-		South        float64
-		East         float64
-		West         float64
-	}{tileName, relTileFile, drawingOrder, tbox[north], tbox[south], tbox[east], tbox[west]}
-	return t.Execute(w, &root)
+	for _, t := range tj.tiles {
+		name := filepath.Base(t.fpath)
+		if err := writeOziImage(filepath.Join(dir, name), t.fpath, strings.TrimSuffix(name, filepath.Ext(name)), t.width, t.height, t.quad); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func endKML(w io.Writer) error {
-	t, err := template.New("kmlftr").Parse(kmlFtr)
-	if err != nil {
-		return err
+// maxRespendPasses limits how many times chopAll re-cuts images to
+// spend the tiles freed by dropping blank ones
+const maxRespendPasses = 6
+
+// chopAll cuts the jobs into tiles, returning the GroundOverlays of
+// each job's tiles. If blank tiles are dropped, the freed tiles are
+// re-spent on whichever images were reduced: they are re-cut at
+// higher resolution, as much as keeps them to maxTiles in all.
+func chopAll(ib ImageBackend, jobs []*tileJob, maxTiles int) ([][]*kmlOverlay, error) {
+	overlays := make([][]*kmlOverlay, len(jobs))
+	budget := make([]int, len(jobs))
+	skipBlank := false
+	for i, tj := range jobs {
+		budget[i] = tj.maxPixels
+		skipBlank = skipBlank || tj.skipBlank
+	}
+	// cutAt cuts the jobs with their budgets scaled by f, re-using
+	// the cuts of those the same size as last time. Returns the
+	// tiles in all and whether any image is still reduced.
+	cutAt := func(f float64) (total int, reduced bool, err error) {
+		for i, tj := range jobs {
+			px := int(math.Min(float64(tj.width*tj.height), math.Floor(float64(budget[i])*f)))
+			if overlays[i] == nil || px != tj.maxPixels {
+				tj.maxPixels = px
+				if overlays[i], err = tj.cut(ib); err != nil {
+					return 0, false, err
+				}
+			}
+			total += len(overlays[i])
+			reduced = reduced || px < tj.width*tj.height
+		}
+		return total, reduced, nil
 	}
-	return t.Execute(w, nil)
+	total, reduced, err := cutAt(1)
+	if err != nil || !skipBlank || !reduced || total >= maxTiles {
+		return overlays, err
+	}
+
+	// lo is the largest scale known to fit, hi the smallest known
+	// not to, if not 0. Area and so tiles grow about linearly with
+	// the scale.
+	lo, hi := 1.0, 0.0
+	loTotal, f := total, 1.0
+	for pass := 0; pass < maxRespendPasses && reduced; pass++ {
+		if hi == 0 {
+			f = lo * float64(maxTiles) / float64(loTotal+1)
+		} else {
+			f = (lo + hi) / 2
+		}
+		if f <= lo*1.01 {
+			break
+		}
+		glog.Infof("Re-cutting %d blank tile freed images at %.3f times the pixels\n", maxTiles-loTotal, f)
+		if total, reduced, err = cutAt(f); err != nil {
+			return nil, err
+		}
+		if total > maxTiles {
+			hi = f
+			continue
+		}
+		lo, loTotal = f, total
+		if total == maxTiles {
+			break
+		}
+	}
+	if f != lo {
+		if _, _, err = cutAt(lo); err != nil {
+			return nil, err
+		}
+	}
+	return overlays, nil
 }
 
 // finishTileBox completes the tile.box by setting its east and south
@@ -434,52 +1040,15 @@ func normEasting(deg float64) float64 {
 	return deg
 }
 
-func resizeFixToJpg(outFile, inFile string, maxPixArea int) error {
-	// param order super sensitive
-	cmd := exec.Command("convert", "-resize", "@"+fmt.Sprintf("%v", maxPixArea), inFile, "-strip", "-interlace", "none", outFile)
-	glog.Infof("About to run: %#v\n", cmd.Args)
-	_, err := cmd.Output()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func fixToJpg(outFile, inFile string) error {
-	cmd := exec.Command("convert", inFile, "-strip", "-interlace", "none", outFile)
-	glog.Infof("About to run: %#v\n", cmd.Args)
-	_, err := cmd.Output()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func chopToJpgs(fixedJpg, outDir, baseName string) error {
-	outFile := filepath.Join(outDir, baseName+"_tile_%03d.jpg")
-	cmd := exec.Command("convert", "-crop", "1024x1024", fixedJpg, "+adjoin", outFile)
-	glog.Infof("About to run: %#v\n", cmd.Args)
-	_, err := cmd.Output()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 // zipd makes a zip archive of the given dirctory and writes it to the
 // writer. Paths in the zip archive are relative to the base name of
 // the given directory.
 func zipd(dir string, w io.Writer) error {
 	z := zip.NewWriter(w)
-	defer func() {
-		if err := z.Flush(); err != nil {
-			fmt.Printf("Error flushing ZIP writer: %v\n", err)
-		}
-		if err := z.Close(); err != nil {
-			fmt.Printf("Error closing ZIP writer: %v\n", err)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-	}()
-	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			return nil
 		}
@@ -492,16 +1061,16 @@ func zipd(dir string, w io.Writer) error {
 			return err
 		}
 		defer r.Close()
-		zw, err := z.Create(rel)
+		zw, err := z.Create(filepath.ToSlash(rel))
 		if err != nil {
 			return err
 		}
 		_, err = io.Copy(zw, r)
-		if err != nil {
-			return err
-		}
-		return nil
+		return err
 	})
-
-	return nil
+	if err != nil {
+		z.Close()
+		return err
+	}
+	return z.Close()
 }
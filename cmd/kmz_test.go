@@ -1,6 +1,18 @@
 package cmd
 
-import "testing"
+import (
+	"archive/zip"
+	"encoding/xml"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
 
 func TestDelta(t *testing.T) {
 	// this is a critical fcn that must work for any rectangular
@@ -90,3 +102,171 @@ func TestNorm(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two maps of the same name, which must not share tiles
+	var args []string
+	for i, name := range []string{"a/Sector_50_49_-122_-123.0.jpg", "b/Sector_51_50_-122_-123.0.jpg"} {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewGray(image.Rect(0, 0, 1500, 1200))
+		for j := range img.Pix {
+			img.Pix[j] = uint8(j * (i + 1))
+		}
+		if err = writeJpg(fpath, img, jpegQuality); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, fpath)
+	}
+	v := viper.New()
+	v.Set("backend", goBackend)
+	v.Set("max_tiles", 5)
+	v.Set("out", filepath.Join(dir, "sectors"))
+	if err = process(v, args); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(dir, "sectors.kmz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	doc, err := kmzDocKML(&zr.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := doc.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var k struct {
+		Folders []struct {
+			Name     string `xml:"name"`
+			Overlays []struct {
+				DrawOrder int    `xml:"drawOrder"`
+				Href      string `xml:"Icon>href"`
+			} `xml:"GroundOverlay"`
+		} `xml:"Document>Folder"`
+	}
+	if err = xml.NewDecoder(r).Decode(&k); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.Folders) != 2 || k.Folders[0].Name != "Sector" || k.Folders[1].Name != "Sector-2" {
+		t.Fatalf("got folders %+v", k.Folders)
+	}
+	files := kmzFiles(&zr.Reader)
+	tiles := 0
+	for i, f := range k.Folders {
+		for _, o := range f.Overlays {
+			if o.DrawOrder != garminMinDrawOrder+i {
+				t.Errorf("%v drawOrder %d, want %d", o.Href, o.DrawOrder, garminMinDrawOrder+i)
+			}
+			if !strings.HasPrefix(o.Href, "tiles/"+f.Name+"/") || files[o.Href] == nil {
+				t.Errorf("%v: tile %v not in its own dir of the KMZ", f.Name, o.Href)
+			}
+			tiles++
+		}
+	}
+	if tiles == 0 || tiles > 5 {
+		t.Errorf("got %d tiles, want 1 to 5", tiles)
+	}
+}
+
+func TestProcessOziMap(t *testing.T) {
+	dir, src, v := writeTestMap(t, 1500, 1200)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	v.Set("max_tiles", 5)
+	v.Set("ozi_map", true)
+	if err = process(v, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a .map per tile, placing it where the KMZ does
+	overlays, err := readKMZOverlays("Sector.kmz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps, err := filepath.Glob(filepath.Join("Sector-ozi", "*.map"))
+	if err != nil || len(maps) != len(overlays) {
+		t.Fatalf("got .map files %v for %d tiles, %v", maps, len(overlays), err)
+	}
+	ib, err := newImageBackend(goBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range overlays {
+		stem := filepath.Join("Sector-ozi", strings.TrimSuffix(filepath.Base(o.Icon.Href), ".jpg"))
+		om, err := readOziMap(stem + ".map")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, h, err := ib.Identify(stem + ".jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		box, crs, _, rotated, err := om.georef(w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := o.box()
+		if crs != 0 || rotated || !boxNear(box, want[:], 1e-6) {
+			t.Errorf("%v.map places it at %v, the KMZ at %v", stem, box, want)
+		}
+	}
+
+	v.Set("rotation", 10)
+	if err = process(v, []string{src}); err == nil {
+		t.Errorf("expected error for .map files of a rotated map")
+	}
+}
+
+func TestProcessThousandTiles(t *testing.T) {
+	// over 999 tiles the names no longer sort in tile order
+	dir, src, v := writeTestMap(t, 220, 100)
+	defer os.RemoveAll(dir)
+	v.Set("devices.tiny.max_tiles", 2000)
+	v.Set("devices.tiny.max_tile_pixels", 16)
+	v.Set("device", "tiny")
+	v.Set("out", filepath.Join(dir, "tiny"))
+	if err := process(v, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+	overlays, err := readKMZOverlays(filepath.Join(dir, "tiny.kmz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := planTiles(220, 100, 16)
+	if tl.tiles() < 1000 || len(overlays) != tl.tiles() {
+		t.Fatalf("got %d overlays of %d planned tiles", len(overlays), tl.tiles())
+	}
+	for _, o := range overlays {
+		name := strings.TrimSuffix(filepath.Base(o.Icon.Href), ".jpg")
+		i, err := strconv.Atoi(name[strings.LastIndex(name, "_")+1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := tl.tileRect(i, image.Rect(0, 0, 220, 100))
+		box, _ := o.box()
+		want := []float64{50 - float64(r.Min.Y)/100, 50 - float64(r.Max.Y)/100, -123 + float64(r.Max.X)/220, -123 + float64(r.Min.X)/220}
+		if !boxNear(box[:], want, 1e-9) {
+			t.Fatalf("%v at %v, want %v", o.Icon.Href, box, want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// mbtilesCmd represents the mbtiles command
+var mbtilesCmd = &cobra.Command{
+	Use:   "mbtiles",
+	Short: "Produces an MBTiles file of Web Mercator tiles for offline phone apps",
+	Long: `Renders the name-geo-anchored JPG (or GeoTIFF or image with a world
+file, as for the kmz subcommand) into Web Mercator tiles, as for the
+xyz subcommand, stored in an MBTiles SQLite file that phone apps such
+as OsmAnd, Locus and Avenza can import, e.g.
+
+    cutkmz mbtiles Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+creates Grouse-Mountain.mbtiles in the current directory, or the file
+given by --out. Its metadata table holds the map's name, bounds,
+center, minzoom, maxzoom and format, with type overlay.
+
+The zoom levels default as per the xyz subcommand; give --min_zoom
+and --max_zoom to choose others. Tiles are PNGs, transparent where
+the map doesn't cover them, or JPGs with --format jpg, which are
+smaller but white there.
+
+MBTiles files are written with SQLite through cgo, which needs a C
+compiler to build, so this subcommand only works in cutkmz built with the
+mbtiles tag:
+
+    go build -tags mbtiles github.com/msample/cutkmz
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processMBTiles(viper.GetViper(), args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz mbtiles -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mbtilesCmd)
+
+	mbtilesCmd.Flags().Int("min_zoom", -1, "shallowest zoom level to make tiles for. -1 means the one showing the map's width in one tile.")
+	viper.BindPFlag("min_zoom", mbtilesCmd.Flags().Lookup("min_zoom"))
+
+	mbtilesCmd.Flags().Int("max_zoom", -1, "deepest zoom level to make tiles for, up to 22. -1 means the one with at least the image's resolution.")
+	viper.BindPFlag("max_zoom", mbtilesCmd.Flags().Lookup("max_zoom"))
+
+	mbtilesCmd.Flags().String("format", "png", "tile image format: png or jpg.")
+	viper.BindPFlag("format", mbtilesCmd.Flags().Lookup("format"))
+
+	mbtilesCmd.Flags().StringP("out", "o", "", "MBTiles file to write. Default is the map's name with .mbtiles added.")
+	viper.BindPFlag("out", mbtilesCmd.Flags().Lookup("out"))
+
+	mbtilesCmd.Flags().Int("src_crs", 0, "EPSG code of a projected world file or GeoTIFF, e.g. 32610 for UTM zone 10N. Reprojects to lat/long.")
+	viper.BindPFlag("src_crs", mbtilesCmd.Flags().Lookup("src_crs"))
+
+	mbtilesCmd.Flags().BoolP("keep_tmp", "k", false, "Don't delete intermediate files from $TMPDIR.")
+	viper.BindPFlag("keep_tmp", mbtilesCmd.Flags().Lookup("keep_tmp"))
+
+	mbtilesCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, mbtilesCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// mbtilesDriver is the database/sql driver MBTiles are written with,
+// registered in builds with the mbtiles tag
+const mbtilesDriver = "sqlite3"
+
+// mbtilesSupported returns true if cutkmz was built with the mbtiles
+// tag, which adds the SQLite driver
+func mbtilesSupported() bool {
+	for _, d := range sql.Drivers() {
+		if d == mbtilesDriver {
+			return true
+		}
+	}
+	return false
+}
+
+// mbtilesSchema creates the tables of an MBTiles 1.3 file
+const mbtilesSchema = `
+CREATE TABLE metadata (name text, value text);
+CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+// processMBTiles renders each image in args into an MBTiles file.
+// Uses "min_zoom", "max_zoom", "format", "out", "src_crs" and
+// "keep_tmp" from viper if present.
+func processMBTiles(v *viper.Viper, args []string) error {
+	format := v.GetString("format")
+	out := v.GetString("out")
+	keepTmp := v.GetBool("keep_tmp")
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
+
+	if !mbtilesSupported() {
+		return fmt.Errorf("This cutkmz was built without MBTiles support, rebuild it with: go build -tags mbtiles (needs cgo and a C compiler)")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("Image file required: must provide one or more image file path")
+	}
+	if len(args) > 1 && out != "" {
+		return fmt.Errorf("Only one image at a time can be written to an --out file")
+	}
+	if !validWebTileFormat(format) {
+		return fmt.Errorf("Tile format must be one of %v, got %q", webTileFormats, format)
+	}
+	for _, image := range args {
+		if _, err := os.Stat(image); os.IsNotExist(err) {
+			return err
+		}
+		tmpDir, err := ioutil.TempDir("", "cutkmz-")
+		if err != nil {
+			return fmt.Errorf("Error creating a temporary directory: %v", err)
+		}
+		base, img, box, err := latLongMap(ib, tmpDir, image, v.GetInt("src_crs"))
+		if err != nil {
+			return err
+		}
+		width, _, err := ib.Identify(img)
+		if err != nil {
+			return err
+		}
+		minZ, maxZ, err := zoomFlags(v, width, box)
+		if err != nil {
+			return err
+		}
+		mbt := out
+		if mbt == "" {
+			mbt = base + ".mbtiles"
+		}
+		if err = writeMBTiles(ib, mbt, img, tmpDir, base, box, minZ, maxZ, format); err != nil {
+			return fmt.Errorf("Error writing %v: %v", mbt, err)
+		}
+
+		if !keepTmp {
+			if err = os.RemoveAll(tmpDir); err != nil {
+				return fmt.Errorf("Error removing tmp dir & contents: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeMBTiles writes the MBTiles file mbt, replacing any, holding the
+// tiles of zooms minZ to maxZ rendered from the named lat/long image
+// img covering box, and their metadata
+func writeMBTiles(ib ImageBackend, mbt, img, tmpDir, name string, box []float64, minZ, maxZ int, format string) error {
+	if err := os.Remove(mbt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open(mbtilesDriver, mbt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err = db.Exec(mbtilesSchema); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	lon, lat := boxCenter(box)
+	ff := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	for _, kv := range [][2]string{
+		{"name", name},
+		{"format", format},
+		{"bounds", strings.Join([]string{ff(box[west]), ff(box[south]), ff(box[east]), ff(box[north])}, ",")},
+		{"center", strings.Join([]string{ff(lon), ff(lat), strconv.Itoa(minZ)}, ",")},
+		{"minzoom", strconv.Itoa(minZ)},
+		{"maxzoom", strconv.Itoa(maxZ)},
+		{"type", "overlay"},
+	} {
+		if _, err = tx.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	insert, err := tx.Prepare("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	n, err := renderWebTiles(ib, img, tmpDir, box, minZ, maxZ, format, func(t webTile, b []byte) error {
+		// MBTiles rows count north from the south, as in TMS
+		_, err := insert.Exec(t.z, t.x, 1<<uint(t.z)-1-t.y, b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("%v: %d tiles, zoom %d to %d\n", mbt, n, minZ, maxZ)
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build mbtiles
+
+package cmd
+
+import (
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 database/sql driver
+)
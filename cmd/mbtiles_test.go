@@ -0,0 +1,76 @@
+//go:build mbtiles
+
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessMBTiles(t *testing.T) {
+	dir, src, v := writeTestMap(t, 1000, 500)
+	defer os.RemoveAll(dir)
+	mbt := filepath.Join(dir, "sector.mbtiles")
+	v.Set("min_zoom", 7)
+	v.Set("max_zoom", 8)
+	v.Set("format", "jpg")
+	v.Set("out", mbt)
+	if err := processMBTiles(v, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(mbtilesDriver, mbt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	meta := map[string]string{}
+	rows, err := db.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var k, val string
+		if err = rows.Scan(&k, &val); err != nil {
+			t.Fatal(err)
+		}
+		meta[k] = val
+	}
+	rows.Close()
+	for k, want := range map[string]string{"name": "Sector", "format": "jpg", "bounds": "-123,49,-122,50", "minzoom": "7", "maxzoom": "8"} {
+		if meta[k] != want {
+			t.Errorf("metadata %v is %q, want %q", k, meta[k], want)
+		}
+	}
+
+	// a point in the NW and one in the SE quarter, in rows counting
+	// from the south
+	for _, pt := range []struct {
+		lon, lat float64
+		quarter  int
+	}{{-122.8, 49.8, nw}, {-122.2, 49.2, se}} {
+		tile, p := webTilePixel(pt.lon, pt.lat, 8)
+		var b []byte
+		if err = db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+			tile.z, tile.x, 1<<uint(tile.z)-1-tile.y).Scan(&b); err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("tile %v is not a JPEG: %v", tile, err)
+		}
+		checkColor(t, fmt.Sprint("tile ", tile), img, p, pt.quarter)
+	}
+	var n int
+	if err = db.QueryRow("SELECT count(*) FROM tiles WHERE zoom_level = 7").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Errorf("no zoom 7 tiles")
+	}
+}
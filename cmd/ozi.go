@@ -0,0 +1,535 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// oziDatums are the datums of OziExplorer .map files that are
+// supported, by the names Ozi gives them
+var oziDatums = map[string]datum{
+	"WGS 84":             {wgs84, 0, 0, 0},
+	"NAD83":              {grs80, 0, 0, 0},
+	"NAD27 CONUS":        {clarke1866, -8, 160, 176},
+	"NAD27 Canada":       {clarke1866, -10, 158, 187},
+	"NAD27 Alaska":       {clarke1866, -5, 135, 172},
+	"European 1950":      {intl1924, -87, -98, -121},
+	"Ord Srvy Grt Britn": {airy1830, 375, -111, 431},
+	"Tokyo":              {bessel1841, -148, 507, 685},
+	"Pulkovo 1942 (1)":   {krassovsky, 28, -130, -95},
+}
+
+// Ozi map projections that are supported
+const (
+	oziLatLong = "Latitude/Longitude"
+	oziUTM     = "(UTM) Universal Transverse Mercator"
+)
+
+// oziPoint is a calibration point of an Ozi map: a pixel x, y of the
+// image and either its lat/long on the map's datum or its UTM grid
+// position
+type oziPoint struct {
+	x, y     float64
+	lon, lat float64
+	grid     bool
+	zone     int
+	south    bool
+	easting  float64
+	northing float64
+}
+
+// oziMap is what's needed of an OziExplorer .map file to place its
+// image
+type oziMap struct {
+	fpath         string
+	datum         string
+	projection    string
+	points        []oziPoint
+	width, height int // of the image calibrated, 0 if not given
+}
+
+// findOziMap returns the path of the OziExplorer .map file for the
+// given image, e.g. mymap.map for mymap.jpg, or "" if there is none
+func findOziMap(image string) string {
+	stem := strings.TrimSuffix(image, filepath.Ext(image))
+	for _, p := range []string{stem + ".map", stem + ".MAP"} {
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+// readOziMap parses the datum, projection, calibration points and
+// image size of the given .map file. The MMPXY & MMPLL corners are
+// used as calibration points if it has fewer than 2 of its own.
+func readOziMap(fpath string) (*oziMap, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	om := &oziMap{fpath: fpath}
+	mmpxy, mmpll := map[string][]string{}, map[string][]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		l := strings.TrimSpace(s.Text())
+		c := strings.Split(l, ",")
+		for i := range c {
+			c[i] = strings.TrimSpace(c[i])
+		}
+		switch {
+		case n == 1:
+			if !strings.HasPrefix(l, "OziExplorer Map Data File") {
+				return nil, fmt.Errorf("%v is not an OziExplorer .map file", fpath)
+			}
+		case n == 5:
+			om.datum = c[0]
+		case c[0] == "Map Projection" && len(c) > 1:
+			om.projection = c[1]
+		case strings.HasPrefix(c[0], "Point"):
+			p, ok, err := parseOziPoint(c)
+			if err != nil {
+				return nil, fmt.Errorf("Error with %v line %d: %v", fpath, n, err)
+			}
+			if ok {
+				om.points = append(om.points, p)
+			}
+		case c[0] == "MMPXY" && len(c) >= 4:
+			mmpxy[c[1]] = c[2:4]
+		case c[0] == "MMPLL" && len(c) >= 4:
+			mmpll[c[1]] = c[2:4]
+		case c[0] == "IWH" && len(c) >= 4:
+			om.width, _ = strconv.Atoi(c[2])
+			om.height, _ = strconv.Atoi(c[3])
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	if len(om.points) < 2 {
+		om.points = nil
+		for i, xy := range mmpxy {
+			ll, ok := mmpll[i]
+			if !ok {
+				continue
+			}
+			v, err := parseFloats(strings.Join(append(append([]string{}, xy...), ll...), ","), 4)
+			if err != nil {
+				return nil, fmt.Errorf("Error with %v MMPXY/MMPLL %v: %v", fpath, i, err)
+			}
+			om.points = append(om.points, oziPoint{x: v[0], y: v[1], lon: v[2], lat: v[3]})
+		}
+	}
+	return om, nil
+}
+
+// parseOziPoint parses the comma separated fields of a calibration
+// point line. False if the point is not used.
+//
+//	Point01,xy,  0,  0,in, deg, 49, 28.2377,N, 123, 7.9234,W, grid, 10, 490000, 5480000,N
+func parseOziPoint(c []string) (p oziPoint, ok bool, err error) {
+	if len(c) < 17 || c[2] == "" || c[3] == "" {
+		return p, false, nil
+	}
+	if p.x, err = strconv.ParseFloat(c[2], 64); err != nil {
+		return p, false, err
+	}
+	if p.y, err = strconv.ParseFloat(c[3], 64); err != nil {
+		return p, false, err
+	}
+	switch {
+	case c[6] != "" && c[9] != "":
+		if p.lat, err = oziDegrees(c[6], c[7], c[8] == "S"); err != nil {
+			return p, false, err
+		}
+		if p.lon, err = oziDegrees(c[9], c[10], c[11] == "W"); err != nil {
+			return p, false, err
+		}
+	case c[14] != "" && c[15] != "":
+		p.grid = true
+		if p.zone, err = strconv.Atoi(strings.TrimRight(c[13], "ABCDEFGHJKLMNPQRSTUVWXYZ")); err != nil {
+			return p, false, fmt.Errorf("Bad UTM zone %q", c[13])
+		}
+		if p.easting, err = strconv.ParseFloat(c[14], 64); err != nil {
+			return p, false, err
+		}
+		if p.northing, err = strconv.ParseFloat(c[15], 64); err != nil {
+			return p, false, err
+		}
+		p.south = c[16] == "S"
+	default:
+		return p, false, nil
+	}
+	return p, true, nil
+}
+
+// oziDegrees returns the decimal degrees of the given whole degrees
+// and decimal minutes, negated if neg
+func oziDegrees(d, m string, neg bool) (float64, error) {
+	deg, err := strconv.ParseFloat(d, 64)
+	if err != nil {
+		return 0, err
+	}
+	min := 0.0
+	if m != "" {
+		if min, err = strconv.ParseFloat(m, 64); err != nil {
+			return 0, err
+		}
+	}
+	deg += min / 60
+	if neg {
+		deg = -deg
+	}
+	return deg, nil
+}
+
+// affine maps pixel x, y to map x, y:
+//
+//	mx = a*x + b*y + c
+//	my = d*x + e*y + f
+type affine struct {
+	a, b, c, d, e, f float64
+}
+
+// apply returns the map x, y of pixel x, y
+func (af affine) apply(x, y float64) (float64, float64) {
+	return af.a*x + af.b*y + af.c, af.d*x + af.e*y + af.f
+}
+
+// northUp returns true if a width x height image turns by less than
+// half a pixel from north-up across its width or height
+func (af affine) northUp(width, height int) bool {
+	return math.Abs(af.b*float64(height)) < math.Abs(af.a)/2 && math.Abs(af.d*float64(width)) < math.Abs(af.e)/2
+}
+
+// fitAffine returns the least squares affine mapping the pixel x, y
+// points to the map x, y points. Two points, or points in a line,
+// give a north-up affine from the two farthest apart.
+func fitAffine(px, py, mx, my []float64) (affine, error) {
+	var af affine
+	n := float64(len(px))
+	if len(px) >= 3 {
+		// normal equations of [x y 1] . [a b c] = mx and likewise for my
+		var sxx, sxy, syy, sx, sy, sxm, sym, sm, sxn, syn, sn float64
+		for i := range px {
+			x, y := px[i], py[i]
+			sxx, sxy, syy, sx, sy = sxx+x*x, sxy+x*y, syy+y*y, sx+x, sy+y
+			sxm, sym, sm = sxm+x*mx[i], sym+y*mx[i], sm+mx[i]
+			sxn, syn, sn = sxn+x*my[i], syn+y*my[i], sn+my[i]
+		}
+		det3 := func(a, b, c, d, e, f, g, h, i float64) float64 {
+			return a*(e*i-f*h) - b*(d*i-f*g) + c*(d*h-e*g)
+		}
+		det := det3(sxx, sxy, sx, sxy, syy, sy, sx, sy, n)
+		scale := (sxx + syy) * (sxx + syy) * n
+		if math.Abs(det) > 1e-9*scale {
+			af.a = det3(sxm, sxy, sx, sym, syy, sy, sm, sy, n) / det
+			af.b = det3(sxx, sxm, sx, sxy, sym, sy, sx, sm, n) / det
+			af.c = det3(sxx, sxy, sxm, sxy, syy, sym, sx, sy, sm) / det
+			af.d = det3(sxn, sxy, sx, syn, syy, sy, sn, sy, n) / det
+			af.e = det3(sxx, sxn, sx, sxy, syn, sy, sx, sn, n) / det
+			af.f = det3(sxx, sxy, sxn, sxy, syy, syn, sx, sy, sn) / det
+			return af, nil
+		}
+	}
+	best, bi, bj := 0.0, 0, 0
+	for i := range px {
+		for j := i + 1; j < len(px); j++ {
+			if a := math.Abs((px[j] - px[i]) * (py[j] - py[i])); a > best {
+				best, bi, bj = a, i, j
+			}
+		}
+	}
+	if best == 0 {
+		return af, fmt.Errorf("Need at least 2 calibration points differing in both x and y")
+	}
+	af.a = (mx[bj] - mx[bi]) / (px[bj] - px[bi])
+	af.e = (my[bj] - my[bi]) / (py[bj] - py[bi])
+	af.c = mx[bi] - af.a*px[bi]
+	af.f = my[bi] - af.e*py[bi]
+	return af, nil
+}
+
+// lookupOziDatum returns the datum of the given Ozi name
+func lookupOziDatum(name string) (datum, error) {
+	for n, d := range oziDatums {
+		if strings.EqualFold(n, name) {
+			return d, nil
+		}
+	}
+	var names []string
+	for n := range oziDatums {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return datum{}, fmt.Errorf("Datum %q is not supported. Supported are %v", name, strings.Join(names, ", "))
+}
+
+// georef returns how the map's width x height image is placed. If it
+// is north-up in a WGS84 or NAD83 UTM zone, that's the box in the UTM
+// CRS returned. Otherwise if it is north-up in lat/long, the lat/long
+// box with crs 0. Otherwise it is rotated and the WGS84 lat/long of
+// its NW, NE, SE & SW corners are returned, with the box around them.
+func (om *oziMap) georef(width, height int) (box []float64, crs int, quad [4][2]float64, rotated bool, err error) {
+	d, err := lookupOziDatum(om.datum)
+	if err != nil {
+		return nil, 0, quad, false, fmt.Errorf("Error with %v: %v", om.fpath, err)
+	}
+	if len(om.points) < 2 {
+		return nil, 0, quad, false, fmt.Errorf("%v has %d calibration points, need at least 2", om.fpath, len(om.points))
+	}
+
+	var proj projection // nil for lat/long
+	zone, southern := 0, false
+	switch om.projection {
+	case oziLatLong:
+	case oziUTM:
+		// zone of the first grid point, else of the points' middle
+		var lon, lat float64
+		for _, p := range om.points {
+			if p.grid {
+				zone, southern = p.zone, p.south
+				break
+			}
+			lon, lat = lon+p.lon/float64(len(om.points)), lat+p.lat/float64(len(om.points))
+		}
+		if zone == 0 {
+			zone, southern = int(math.Floor((normEasting(lon)+180)/6))%60+1, lat < 0
+		}
+		proj = newUTM(d.el, zone, southern)
+	default:
+		return nil, 0, quad, false, fmt.Errorf("%v projection %q is not supported, only %q and %q", om.fpath, om.projection, oziLatLong, oziUTM)
+	}
+
+	// the image may have been resized since it was calibrated
+	sx, sy := 1.0, 1.0
+	if om.width > 0 && om.height > 0 {
+		sx, sy = float64(width)/float64(om.width), float64(height)/float64(om.height)
+	}
+	var px, py, mx, my []float64
+	for _, p := range om.points {
+		x, y := p.lon, p.lat
+		switch {
+		case p.grid && proj == nil:
+			return nil, 0, quad, false, fmt.Errorf("%v has UTM grid calibration points but is not in UTM", om.fpath)
+		case p.grid:
+			if p.zone != zone || p.south != southern {
+				return nil, 0, quad, false, fmt.Errorf("%v calibration points are in more than one UTM zone", om.fpath)
+			}
+			x, y = p.easting, p.northing
+		case proj != nil:
+			x, y = proj.forward(p.lon, p.lat)
+		}
+		px, py, mx, my = append(px, p.x*sx), append(py, p.y*sy), append(mx, x), append(my, y)
+	}
+	af, err := fitAffine(px, py, mx, my)
+	if err != nil {
+		return nil, 0, quad, false, fmt.Errorf("Error with %v: %v", om.fpath, err)
+	}
+
+	if proj != nil && af.northUp(width, height) {
+		switch {
+		case d == oziDatums["WGS 84"] && !southern:
+			crs = 32600 + zone
+		case d == oziDatums["WGS 84"]:
+			crs = 32700 + zone
+		case d == oziDatums["NAD83"] && !southern && zone <= 23:
+			crs = 26900 + zone
+		}
+		if crs != 0 {
+			box = make([]float64, 4)
+			box[west], box[north] = af.c, af.f
+			box[east], box[south] = af.apply(float64(width), float64(height))
+			return box, crs, quad, false, checkProjectedBox(box)
+		}
+	}
+
+	w, h := float64(width), float64(height)
+	for i, c := range [4][2]float64{nw: {0, 0}, ne: {w, 0}, se: {w, h}, sw: {0, h}} {
+		x, y := af.apply(c[0], c[1])
+		if proj != nil {
+			x, y = proj.inverse(x, y)
+		}
+		lon, lat := d.toWGS84(x, y)
+		quad[i] = [2]float64{lat, normEasting(lon)}
+	}
+	box = quadBox(quad)
+	if err = checkBox(box); err != nil {
+		return nil, 0, quad, false, fmt.Errorf("Error with %v: %v", om.fpath, err)
+	}
+
+	// north-up in lat/long if the corners line up to half a pixel
+	latTol := (box[north] - box[south]) / h / 2
+	lonTol := eastDelta(box[east], box[west]) / w / 2
+	if math.Abs(quad[nw][cornerLat]-quad[ne][cornerLat]) < latTol &&
+		math.Abs(quad[sw][cornerLat]-quad[se][cornerLat]) < latTol &&
+		math.Abs(normEasting(quad[nw][cornerLon]-quad[sw][cornerLon])) < lonTol &&
+		math.Abs(normEasting(quad[ne][cornerLon]-quad[se][cornerLon])) < lonTol {
+		box[north] = (quad[nw][cornerLat] + quad[ne][cornerLat]) / 2
+		box[south] = (quad[sw][cornerLat] + quad[se][cornerLat]) / 2
+		box[west] = normEasting(quad[nw][cornerLon] + normEasting(quad[sw][cornerLon]-quad[nw][cornerLon])/2)
+		box[east] = normEasting(quad[ne][cornerLon] + normEasting(quad[se][cornerLon]-quad[ne][cornerLon])/2)
+		return box, 0, quad, false, nil
+	}
+	return box, 0, quad, true, nil
+}
+
+// oziMapBox returns what mapBox does for an image placed by the given
+// .map file, which must be north-up
+func oziMapBox(ib ImageBackend, image, omPath string, srcCRS int) (base string, box []float64, crs int, err error) {
+	if srcCRS != 0 {
+		return "", nil, 0, fmt.Errorf("%v gives its own datum and projection, don't give a source CRS", omPath)
+	}
+	om, err := readOziMap(omPath)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	wid, high, err := ib.Identify(image)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	box, crs, _, rotated, err := om.georef(wid, high)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if rotated {
+		return "", nil, 0, fmt.Errorf("%v is not north-up. Only one such map at a time can be placed, by its corners, with the kmz or bigkmz subcommands", omPath)
+	}
+	return strings.TrimSuffix(filepath.Base(image), filepath.Ext(image)), box, crs, nil
+}
+
+// oziCorners returns the corners of the image placed by its .map file,
+// if it has one, no world file or GeoTIFF tags, and is not north-up.
+// An error if a srcCRS or rotation is given for such an image, as
+// they conflict with the .map file's.
+func oziCorners(ib ImageBackend, image string, srcCRS int, rotation float64) (quad [4][2]float64, hasQuad bool, err error) {
+	omPath := findOziMap(image)
+	if omPath == "" || findWorldFile(image) != "" {
+		return quad, false, nil
+	}
+	if ext := strings.ToLower(filepath.Ext(image)); ext == ".tif" || ext == ".tiff" {
+		if _, err := readGeoTIFF(image); err == nil {
+			return quad, false, nil
+		}
+	}
+	om, err := readOziMap(omPath)
+	if err != nil {
+		return quad, false, err
+	}
+	wid, high, err := ib.Identify(image)
+	if err != nil {
+		return quad, false, err
+	}
+	_, _, quad, rotated, err := om.georef(wid, high)
+	if err != nil || !rotated {
+		return quad, false, err
+	}
+	if srcCRS != 0 && !isLatLongCRS(srcCRS) {
+		return quad, false, fmt.Errorf("%v gives its own datum and projection, don't give a source CRS", omPath)
+	}
+	if rotation != 0 {
+		return quad, false, fmt.Errorf("%v places the map by its corners, don't give a rotation too", omPath)
+	}
+	return quad, true, nil
+}
+
+// writeOziMap writes an OziExplorer .map file to fpath calibrating the
+// width x height image imageFile, in the same directory, by the WGS84
+// lat/long of its NW, NE, SE & SW corners
+func writeOziMap(fpath, title, imageFile string, width, height int, quad [4][2]float64) error {
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", a...) // Ozi is a Windows program
+	}
+	line("OziExplorer Map Data File Version 2.2")
+	line("%s", title)
+	line("%s", imageFile)
+	line("1 ,Map Code,")
+	line("WGS 84,WGS 84,   0.0000,   0.0000,WGS 84")
+	line("Reserved 1")
+	line("Reserved 2")
+	line("Magnetic Variation,,,E")
+	line("Map Projection,%s,PolyCal,No,AutoCalOnly,No,BSBUseWPX,No", oziLatLong)
+	pix := [4][2]int{nw: {0, 0}, ne: {width, 0}, se: {width, height}, sw: {0, height}}
+	dm := func(deg float64) (int, float64) {
+		deg = math.Abs(deg)
+		return int(deg), (deg - math.Floor(deg)) * 60
+	}
+	for i := 0; i < 30; i++ {
+		if i >= len(quad) {
+			line("Point%02d,xy,     ,     ,in, deg,    ,        ,N,    ,        ,W, grid,   ,           ,           ,N", i+1)
+			continue
+		}
+		ns, ew := "N", "E"
+		if quad[i][cornerLat] < 0 {
+			ns = "S"
+		}
+		if quad[i][cornerLon] < 0 {
+			ew = "W"
+		}
+		latD, latM := dm(quad[i][cornerLat])
+		lonD, lonM := dm(quad[i][cornerLon])
+		line("Point%02d,xy,%5d,%5d,in, deg,%4d,%10.6f,%s,%4d,%10.6f,%s, grid,   ,           ,           ,N",
+			i+1, pix[i][0], pix[i][1], latD, latM, ns, lonD, lonM, ew)
+	}
+	line("Projection Setup,,,,,,,,,,")
+	line("Map Feature = MF ; Map Comment = MC     These follow if they exist")
+	line("Track File = TF      These follow if they exist")
+	line("Moving Map Parameters = MM?    These follow if they exist")
+	line("MM0,Yes")
+	line("MMPNUM,4")
+	for i := range pix {
+		line("MMPXY,%d,%d,%d", i+1, pix[i][0], pix[i][1])
+	}
+	for i := range quad {
+		line("MMPLL,%d,%12.6f,%12.6f", i+1, quad[i][cornerLon], quad[i][cornerLat])
+	}
+	midLat := (quad[nw][cornerLat] + quad[sw][cornerLat]) / 2
+	line("MM1B,%f", eastDelta(quad[ne][cornerLon], quad[nw][cornerLon])*metresPerDegree*math.Cos(rad(midLat))/float64(width))
+	line("MOP,Map Open Position,0,0")
+	line("IWH,Map Image Width/Height,%d,%d", width, height)
+
+	return writeFileString(fpath, b.String())
+}
+
+// writeOziImage copies the width x height image src to dst and
+// writes an OziExplorer .map file beside it calibrating it by the WGS84
+// lat/long of its NW, NE, SE & SW corners
+func writeOziImage(dst, src, title string, width, height int, quad [4][2]float64) error {
+	if err := copyFile(dst, src); err != nil {
+		return err
+	}
+	omPath := strings.TrimSuffix(dst, filepath.Ext(dst)) + ".map"
+	return writeOziMap(omPath, title, filepath.Base(dst), width, height, quad)
+}
+
+// boxQuad returns the NW, NE, SE & SW corners of the north, south,
+// east, west box
+func boxQuad(box []float64) [4][2]float64 {
+	return [4][2]float64{
+		nw: {box[north], box[west]},
+		ne: {box[north], box[east]},
+		se: {box[south], box[east]},
+		sw: {box[south], box[west]},
+	}
+}
+
+// writeFileString writes s to the file fpath, replacing any
+func writeFileString(fpath, s string) error {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
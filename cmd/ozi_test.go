@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// oziMapText returns a .map file of the given datum and projection
+// with the given Point lines
+func oziMapText(datum, projection string, points ...string) string {
+	lines := []string{
+		"OziExplorer Map Data File Version 2.2",
+		"Grouse Mountain",
+		"scan.jpg",
+		"1 ,Map Code,",
+		datum + "," + datum + ",   0.0000,   0.0000," + datum,
+		"Reserved 1",
+		"Reserved 2",
+		"Magnetic Variation,,,E",
+		"Map Projection," + projection + ",PolyCal,No,AutoCalOnly,No,BSBUseWPX,No",
+	}
+	lines = append(lines, points...)
+	lines = append(lines, "IWH,Map Image Width/Height,1000,500")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// turnedOziMapText returns a .map file of a 1000x500 image turned 10
+// degrees counter-clockwise, its NW corner at 490000,5480000 in UTM
+// zone 10N
+func turnedOziMapText() string {
+	var points []string
+	s, c := math.Sin(rad(10)), math.Cos(rad(10))
+	for i, p := range [][2]float64{{0, 0}, {1000, 0}, {1000, 500}} {
+		x, y := 490000+10*(c*p[0]+s*p[1]), 5480000+10*(s*p[0]-c*p[1])
+		points = append(points, fmt.Sprintf("Point%02d,xy,%5.0f,%5.0f,in, deg,    ,        ,N,    ,        ,W, grid, 10, %10.2f, %10.2f,N", i+1, p[0], p[1], x, y))
+	}
+	return oziMapText("WGS 84", oziUTM, points...)
+}
+
+// writeOziTest writes s to scan.map in dir and reads it back
+func writeOziTest(t *testing.T, dir, s string) *oziMap {
+	fpath := filepath.Join(dir, "scan.map")
+	if err := ioutil.WriteFile(fpath, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	om, err := readOziMap(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return om
+}
+
+func TestOziMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// lat/long degrees & minutes, calibrated at half size
+	om := writeOziTest(t, dir, oziMapText("WGS 84", oziLatLong,
+		"Point01,xy,    0,    0,in, deg,  50,  0.0000,N, 123,  0.0000,W, grid,   ,           ,           ,N",
+		"Point02,xy, 1000,  500,in, deg,  49, 30.0000,N, 122,  0.0000,W, grid,   ,           ,           ,N",
+		"Point03,xy,     ,     ,in, deg,    ,        ,N,    ,        ,W, grid,   ,           ,           ,N",
+	))
+	if len(om.points) != 2 || om.datum != "WGS 84" || om.width != 1000 {
+		t.Fatalf("read %+v", om)
+	}
+	box, crs, _, rotated, err := om.georef(2000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{50, 49.5, -122, -123}
+	if crs != 0 || rotated || !boxNear(box, want, 1e-9) {
+		t.Errorf("got box %v crs %v rotated %v, want %v", box, crs, rotated, want)
+	}
+
+	// NAD27 is shifted some 100m from WGS84 in BC
+	om.datum = "nad27 conus"
+	if box, _, _, _, err = om.georef(2000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if d := math.Abs(box[north]-want[north]) + math.Abs(box[west]-want[west]); d < 0.0005 || d > 0.005 {
+		t.Errorf("NAD27 box %v is not shifted about 100m from %v", box, want)
+	}
+	om.datum = "Mars 2000"
+	if _, _, _, _, err = om.georef(2000, 1000); err == nil {
+		t.Errorf("expected error for an unsupported datum")
+	}
+
+	// north-up UTM grid points give the UTM box and its EPSG code
+	om = writeOziTest(t, dir, oziMapText("WGS 84", oziUTM,
+		"Point01,xy,    0,    0,in, deg,    ,        ,N,    ,        ,W, grid, 10,   490000,  5480000,N",
+		"Point02,xy, 1000,  500,in, deg,    ,        ,N,    ,        ,W, grid, 10,   500000,  5475000,N",
+		"Point03,xy, 1000,    0,in, deg,    ,        ,N,    ,        ,W, grid, 10,   500000,  5480000,N",
+	))
+	if box, crs, _, rotated, err = om.georef(1000, 500); err != nil {
+		t.Fatal(err)
+	}
+	want = []float64{5480000, 5475000, 500000, 490000}
+	if crs != 32610 || rotated || !boxNear(box, want, 1e-6) {
+		t.Errorf("got box %v crs %v rotated %v, want %v", box, crs, rotated, want)
+	}
+
+	// turned 10 degrees it gives the corners
+	om = writeOziTest(t, dir, turnedOziMapText())
+	_, _, quad, rotated, err := om.georef(1000, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lon, lat := newUTM(wgs84, 10, false).inverse(490000, 5480000)
+	if !rotated || math.Abs(quad[nw][cornerLat]-lat) > 1e-9 || math.Abs(quad[nw][cornerLon]-lon) > 1e-9 {
+		t.Errorf("rotated %v, NW corner %v, want %v,%v", rotated, quad[nw], lat, lon)
+	}
+	if quad[ne][cornerLat] <= quad[nw][cornerLat] {
+		t.Errorf("NE corner %v should be north of NW %v", quad[ne], quad[nw])
+	}
+}
+
+func TestOziMapBox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "scan.jpg")
+	if err = writeJpg(image, newGrayImage(400, 200), jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{49.470628, 49.336694, -122.9811, -123.132056}
+	if err = writeOziMap(filepath.Join(dir, "scan.map"), "Grouse", "scan.jpg", 400, 200, boxQuad(want)); err != nil {
+		t.Fatal(err)
+	}
+	ib, err := newImageBackend(goBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, box, crs, err := mapBox(ib, image, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base != "scan" || crs != 0 || !boxNear(box, want, 1e-6) {
+		t.Errorf("got %v box %v crs %v, want %v", base, box, crs, want)
+	}
+	if _, _, _, err = mapBox(ib, image, 32610); err == nil {
+		t.Errorf("expected error for a source CRS with a .map file")
+	}
+}
+
+func TestOziCorners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "scan.jpg")
+	if err = writeJpg(image, newGrayImage(1000, 500), jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+	writeOziTest(t, dir, turnedOziMapText())
+	ib, err := newImageBackend(goBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	if _, hasQuad, err := cornersFlag(v, ib, 0, []string{image}); err != nil || !hasQuad {
+		t.Errorf("turned map has corners %v, %v", hasQuad, err)
+	}
+	if _, _, err = cornersFlag(v, ib, 5, []string{image}); err == nil {
+		t.Errorf("expected error for a rotation with a turned .map file")
+	}
+	v.Set("src_crs", 32610)
+	if _, _, err = cornersFlag(v, ib, 0, []string{image}); err == nil {
+		t.Errorf("expected error for a source CRS with a turned .map file")
+	}
+}
+
+func TestDatumShift(t *testing.T) {
+	for _, el := range []ellipsoid{wgs84, clarke1866, airy1830} {
+		x, y, z := el.geocentric(-123.1, 49.3)
+		lon, lat := el.geodetic(x, y, z)
+		if math.Abs(lon+123.1) > 1e-9 || math.Abs(lat-49.3) > 1e-9 {
+			t.Errorf("%v round trip gave %v,%v", el, lon, lat)
+		}
+	}
+	// OSGB36 to WGS84 moves Greenwich about 5" west
+	lon, lat := oziDatums["Ord Srvy Grt Britn"].toWGS84(0, 51.4778)
+	if lon > -0.0012 || lon < -0.0020 || math.Abs(lat-51.4778) > 0.001 {
+		t.Errorf("OSGB36 Greenwich is WGS84 %v,%v", lon, lat)
+	}
+}
+
+// boxNear returns true if boxes a and b are within tol of each other
+func boxNear(a, b []float64, tol float64) bool {
+	for i := range b {
+		if math.Abs(a[i]-b[i]) > tol {
+			return false
+		}
+	}
+	return true
+}
+
+// newGrayImage returns a blank width x height image
+func newGrayImage(width, height int) image.Image {
+	return image.NewGray(image.Rect(0, 0, width, height))
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+)
+
+// projection converts between long/lat in decimal degrees and a
+// projected CRS's x (easting) & y (northing) in metres.
+type projection interface {
+	forward(lon, lat float64) (x, y float64)
+	inverse(x, y float64) (lon, lat float64)
+}
+
+// ellipsoid semi-major axis in metres and flattening
+type ellipsoid struct {
+	a, f float64
+}
+
+var (
+	wgs84 = ellipsoid{6378137, 1 / 298.257223563}
+	grs80 = ellipsoid{6378137, 1 / 298.257222101} // NAD83, same as WGS84 to well under a metre
+
+	// of older datums
+	clarke1866 = ellipsoid{6378206.4, 1 / 294.9786982}
+	intl1924   = ellipsoid{6378388, 1 / 297.0}
+	airy1830   = ellipsoid{6377563.396, 1 / 299.3249646}
+	bessel1841 = ellipsoid{6377397.155, 1 / 299.1528128}
+	krassovsky = ellipsoid{6378245, 1 / 298.3}
+)
+
+// e2 returns the ellipsoid's eccentricity squared
+func (el ellipsoid) e2() float64 {
+	return el.f * (2 - el.f)
+}
+
+// datum is an ellipsoid and the shift in metres of its centre from
+// WGS84's, good to a few metres
+type datum struct {
+	el         ellipsoid
+	dx, dy, dz float64
+}
+
+// toWGS84 returns the WGS84 long/lat of the given long/lat on the
+// datum, shifting it through geocentric x, y, z
+func (d datum) toWGS84(lon, lat float64) (float64, float64) {
+	if d.dx == 0 && d.dy == 0 && d.dz == 0 {
+		return lon, lat
+	}
+	x, y, z := d.el.geocentric(lon, lat)
+	return wgs84.geodetic(x+d.dx, y+d.dy, z+d.dz)
+}
+
+// geocentric returns the earth centred x, y, z in metres of the long/lat
+// on the ellipsoid's surface
+func (el ellipsoid) geocentric(lon, lat float64) (x, y, z float64) {
+	e2 := el.e2()
+	sin, cos := math.Sin(rad(lat)), math.Cos(rad(lat))
+	n := el.a / math.Sqrt(1-e2*sin*sin)
+	return n * cos * math.Cos(rad(lon)), n * cos * math.Sin(rad(lon)), n * (1 - e2) * sin
+}
+
+// geodetic returns the long/lat on the ellipsoid of the earth centred
+// x, y, z, ignoring height, by iterating to well under a millimetre
+func (el ellipsoid) geodetic(x, y, z float64) (lon, lat float64) {
+	e2 := el.e2()
+	p := math.Hypot(x, y)
+	phi := math.Atan2(z, p*(1-e2))
+	for i := 0; i < 10; i++ {
+		sin := math.Sin(phi)
+		n := el.a / math.Sqrt(1-e2*sin*sin)
+		phi = math.Atan2(z+e2*n*sin, p)
+	}
+	return deg(math.Atan2(y, x)), deg(phi)
+}
+
+const (
+	epsgWebMercator = 3857
+	epsgBCAlbers    = 3005
+	epsgConusAlbers = 5070
+)
+
+// isLatLongCRS is true for the geographic CRSs whose lat/long
+// coordinates can be used as is. The differences between their datums
+// are a metre or so.
+func isLatLongCRS(epsg int) bool {
+	switch epsg {
+	case 4326, 4269, 4258, 4617, 4283:
+		return true
+	}
+	return false
+}
+
+// newProjection returns the projection of the given EPSG code.
+// Supports UTM zones on WGS84 (326zz north, 327zz south) and NAD83
+// (269zz), Web Mercator (3857), BC Albers (3005) and NAD83 CONUS
+// Albers (5070).
+func newProjection(epsg int) (projection, error) {
+	switch {
+	case epsg > 32600 && epsg <= 32660:
+		return newUTM(wgs84, epsg-32600, false), nil
+	case epsg > 32700 && epsg <= 32760:
+		return newUTM(wgs84, epsg-32700, true), nil
+	case epsg > 26900 && epsg <= 26923:
+		return newUTM(grs80, epsg-26900, false), nil
+	case epsg == epsgWebMercator || epsg == 900913:
+		return webMercator{}, nil
+	case epsg == epsgBCAlbers:
+		return newAlbers(grs80, 45, -126, 50, 58.5, 1000000, 0), nil
+	case epsg == epsgConusAlbers:
+		return newAlbers(grs80, 23, -96, 29.5, 45.5, 0, 0), nil
+	}
+	return nil, fmt.Errorf("Unsupported CRS EPSG:%d. Supported are UTM zones 326zz, 327zz & 269zz, %d, %d and %d",
+		epsg, epsgWebMercator, epsgBCAlbers, epsgConusAlbers)
+}
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+func deg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// transverseMercator is the ellipsoidal transverse Mercator
+// projection, per Snyder's "Map Projections - A Working Manual" p.61.
+type transverseMercator struct {
+	el             ellipsoid
+	lon0, k0       float64 // central meridian degrees, scale there
+	falseE, falseN float64
+}
+
+// newUTM returns the Universal Transverse Mercator projection for the
+// given zone [1,60] in the northern or southern hemisphere.
+func newUTM(el ellipsoid, zone int, southern bool) *transverseMercator {
+	tm := &transverseMercator{el: el, lon0: float64(6*zone - 183), k0: 0.9996, falseE: 500000}
+	if southern {
+		tm.falseN = 10000000
+	}
+	return tm
+}
+
+// meridianArc returns the distance in metres along the central
+// meridian from the equator to latitude phi radians
+func (tm *transverseMercator) meridianArc(phi float64) float64 {
+	e2 := tm.el.e2()
+	e4, e6 := e2*e2, e2*e2*e2
+	return tm.el.a * ((1-e2/4-3*e4/64-5*e6/256)*phi -
+		(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*phi) +
+		(15*e4/256+45*e6/1024)*math.Sin(4*phi) -
+		(35*e6/3072)*math.Sin(6*phi))
+}
+
+func (tm *transverseMercator) forward(lon, lat float64) (x, y float64) {
+	e2 := tm.el.e2()
+	ep2 := e2 / (1 - e2)
+	phi := rad(lat)
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	n := tm.el.a / math.Sqrt(1-e2*sin*sin)
+	t := tan * tan
+	c := ep2 * cos * cos
+	a := rad(normEasting(lon-tm.lon0)) * cos
+	x = tm.k0*n*(a+(1-t+c)*math.Pow(a, 3)/6+(5-18*t+t*t+72*c-58*ep2)*math.Pow(a, 5)/120) + tm.falseE
+	y = tm.k0*(tm.meridianArc(phi)+n*tan*(a*a/2+(5-t+9*c+4*c*c)*math.Pow(a, 4)/24+
+		(61-58*t+t*t+600*c-330*ep2)*math.Pow(a, 6)/720)) + tm.falseN
+	return
+}
+
+func (tm *transverseMercator) inverse(x, y float64) (lon, lat float64) {
+	e2 := tm.el.e2()
+	ep2 := e2 / (1 - e2)
+	m := (y - tm.falseN) / tm.k0
+	mu := m / (tm.el.a * (1 - e2/4 - 3*e2*e2/64 - 5*e2*e2*e2/256))
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+	phi1 := mu + (3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+		(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+		(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+		(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+	sin, cos, tan := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+	c1 := ep2 * cos * cos
+	t1 := tan * tan
+	n1 := tm.el.a / math.Sqrt(1-e2*sin*sin)
+	r1 := tm.el.a * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+	d := (x - tm.falseE) / (n1 * tm.k0)
+	lat = deg(phi1 - (n1*tan/r1)*(d*d/2-(5+3*t1+10*c1-4*c1*c1-9*ep2)*math.Pow(d, 4)/24+
+		(61+90*t1+298*c1+45*t1*t1-252*ep2-3*c1*c1)*math.Pow(d, 6)/720))
+	lon = normEasting(tm.lon0 + deg((d-(1+2*t1+c1)*math.Pow(d, 3)/6+
+		(5-2*c1+28*t1-3*c1*c1+8*ep2+24*t1*t1)*math.Pow(d, 5)/120)/cos))
+	return
+}
+
+// webMercator is the spherical Mercator used by web maps, EPSG:3857
+type webMercator struct{}
+
+func (webMercator) forward(lon, lat float64) (x, y float64) {
+	return wgs84.a * rad(lon), wgs84.a * math.Log(math.Tan(math.Pi/4+rad(lat)/2))
+}
+
+func (webMercator) inverse(x, y float64) (lon, lat float64) {
+	return deg(x / wgs84.a), deg(2*math.Atan(math.Exp(y/wgs84.a)) - math.Pi/2)
+}
+
+// albers is the ellipsoidal Albers equal area conic projection, per
+// Snyder p.101.
+type albers struct {
+	el             ellipsoid
+	lon0           float64
+	n, c, rho0     float64
+	falseE, falseN float64
+}
+
+// newAlbers returns the Albers projection with the given origin,
+// standard parallels and false easting & northing
+func newAlbers(el ellipsoid, lat0, lon0, lat1, lat2, falseE, falseN float64) *albers {
+	al := &albers{el: el, lon0: lon0, falseE: falseE, falseN: falseN}
+	m1, m2 := al.m(rad(lat1)), al.m(rad(lat2))
+	q0, q1, q2 := al.q(rad(lat0)), al.q(rad(lat1)), al.q(rad(lat2))
+	al.n = (m1*m1 - m2*m2) / (q2 - q1)
+	al.c = m1*m1 + al.n*q1
+	al.rho0 = el.a * math.Sqrt(al.c-al.n*q0) / al.n
+	return al
+}
+
+func (al *albers) m(phi float64) float64 {
+	sin := math.Sin(phi)
+	return math.Cos(phi) / math.Sqrt(1-al.el.e2()*sin*sin)
+}
+
+func (al *albers) q(phi float64) float64 {
+	e2 := al.el.e2()
+	e := math.Sqrt(e2)
+	sin := math.Sin(phi)
+	return (1 - e2) * (sin/(1-e2*sin*sin) - math.Log((1-e*sin)/(1+e*sin))/(2*e))
+}
+
+func (al *albers) forward(lon, lat float64) (x, y float64) {
+	rho := al.el.a * math.Sqrt(al.c-al.n*al.q(rad(lat))) / al.n
+	theta := al.n * rad(normEasting(lon-al.lon0))
+	return rho*math.Sin(theta) + al.falseE, al.rho0 - rho*math.Cos(theta) + al.falseN
+}
+
+func (al *albers) inverse(x, y float64) (lon, lat float64) {
+	x, y = x-al.falseE, al.rho0-(y-al.falseN)
+	rho := math.Hypot(x, y)
+	theta := math.Atan2(x, y)
+	if al.n < 0 {
+		rho, theta = -rho, math.Atan2(-x, -y)
+	}
+	q := (al.c - rho*rho*al.n*al.n/(al.el.a*al.el.a)) / al.n
+	e2 := al.el.e2()
+	e := math.Sqrt(e2)
+	phi := math.Asin(q / 2)
+	for i := 0; i < 10; i++ { // converges in 2 or 3
+		sin := math.Sin(phi)
+		dphi := (1 - e2*sin*sin) * (1 - e2*sin*sin) / (2 * math.Cos(phi)) *
+			(q/(1-e2) - sin/(1-e2*sin*sin) + math.Log((1-e*sin)/(1+e*sin))/(2*e))
+		phi += dphi
+		if math.Abs(dphi) < 1e-12 {
+			break
+		}
+	}
+	return normEasting(al.lon0 + deg(theta/al.n)), deg(phi)
+}
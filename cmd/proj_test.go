@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProjections(t *testing.T) {
+	vals := []struct {
+		epsg     int
+		lon, lat float64
+		x, y     float64 // expected, or NaN to only check round trip
+	}{
+		{32610, -123, 49, 500000, 5427455.78},
+		{32610, -123, 0, 500000, 0},
+		{32610, -125.5, 50.1, math.NaN(), math.NaN()},
+		{32733, 15, -20, 500000, math.NaN()},
+		{26910, -121.2, 48.3, math.NaN(), math.NaN()},
+		{epsgWebMercator, 180, 0, 20037508.34, 0},
+		{epsgWebMercator, -123.1, 49.3, math.NaN(), math.NaN()},
+		{epsgBCAlbers, -126, 45, 1000000, 0},
+		{epsgBCAlbers, -123.4, 48.4, math.NaN(), math.NaN()},
+		{epsgConusAlbers, -77, 39, math.NaN(), math.NaN()},
+	}
+	for _, v := range vals {
+		p, err := newProjection(v.epsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y := p.forward(v.lon, v.lat)
+		if !math.IsNaN(v.x) && math.Abs(x-v.x) > 0.01 {
+			t.Errorf("EPSG:%d wrong x: %v, val: %v", v.epsg, x, v)
+		}
+		if !math.IsNaN(v.y) && math.Abs(y-v.y) > 0.01 {
+			t.Errorf("EPSG:%d wrong y: %v, val: %v", v.epsg, y, v)
+		}
+		lon, lat := p.inverse(x, y)
+		if math.Abs(lon-v.lon) > 1e-8 || math.Abs(lat-v.lat) > 1e-8 {
+			t.Errorf("EPSG:%d round trip of %v,%v gave %v,%v", v.epsg, v.lon, v.lat, lon, lat)
+		}
+	}
+	if _, err := newProjection(2056); err == nil {
+		t.Errorf("Expected error for unsupported CRS")
+	}
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// Sides of pyramid tiles allowed with --pyramid_tile
+var pyramidTileSides = []int{256, 512}
+
+// validPyramidTile returns true if side is one of pyramidTileSides
+func validPyramidTile(side int) bool {
+	for _, s := range pyramidTileSides {
+		if side == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pyramid is a quadtree of square tiles of a lat/long image at
+// successive zoom levels. Level 0 is the whole image in one tile; each
+// level after has twice the resolution, the four tiles 2x,2y to
+// 2x+1,2y+1 covering the same area as tile x,y of the level above.
+// Level maxZ is the image at full resolution.
+type pyramid struct {
+	side   int           // of the tiles in pixels
+	maxZ   int           // deepest level
+	box    []float64     // north, south, east, west of the image
+	levels []tileLayout  // of each level's reduced image
+	sizes  []image.Point // of each level's reduced image
+}
+
+// newPyramid returns the pyramid of side x side tiles of a width x
+// height image covering box
+func newPyramid(width, height, side int, box []float64) *pyramid {
+	p := &pyramid{side: side, box: box}
+	for side<<uint(p.maxZ) < width || side<<uint(p.maxZ) < height {
+		p.maxZ++
+	}
+	p.levels = make([]tileLayout, p.maxZ+1)
+	p.sizes = make([]image.Point, p.maxZ+1)
+	for z := 0; z <= p.maxZ; z++ {
+		p.setLevel(z, p.levelSize(z, width, height))
+	}
+	return p
+}
+
+// levelSize returns the size of the image reduced to level z
+func (p *pyramid) levelSize(z, width, height int) image.Point {
+	div := 1 << uint(p.maxZ-z)
+	return image.Pt((width+div-1)/div, (height+div-1)/div)
+}
+
+// setLevel sets the size of the image of level z, which backends may
+// round a pixel or so differently to levelSize
+func (p *pyramid) setLevel(z int, size image.Point) {
+	p.sizes[z] = size
+	p.levels[z] = tileLayout{
+		cols:   (size.X + p.side - 1) / p.side,
+		rows:   (size.Y + p.side - 1) / p.side,
+		width:  p.side,
+		height: p.side,
+	}
+}
+
+// tileBox returns the north, south, east, west box of tile x,y of
+// level z
+func (p *pyramid) tileBox(z, x, y int) []float64 {
+	tl, size := p.levels[z], p.sizes[z]
+	r := tl.tileRect(y*tl.cols+x, image.Rect(0, 0, size.X, size.Y))
+	return subBox(p.box, r, size.X, size.Y, true)
+}
+
+// children returns the x,y of the tiles of level z+1 under tile x,y
+// of level z, none if z is the deepest level. Tiles at the right and
+// bottom edges take any extra columns and rows below them, should a
+// backend have rounded a level's size down.
+func (p *pyramid) children(z, x, y int) []image.Point {
+	if z >= p.maxZ {
+		return nil
+	}
+	var c []image.Point
+	tl, below := p.levels[z], p.levels[z+1]
+	lastX, lastY := 2*x+1, 2*y+1
+	if x == tl.cols-1 {
+		lastX = below.cols - 1
+	}
+	if y == tl.rows-1 {
+		lastY = below.rows - 1
+	}
+	for cy := 2 * y; cy <= lastY && cy < below.rows; cy++ {
+		for cx := 2 * x; cx <= lastX && cx < below.cols; cx++ {
+			c = append(c, image.Pt(cx, cy))
+		}
+	}
+	return c
+}
+
+// tiles returns the number of tiles in all levels
+func (p *pyramid) tiles() int {
+	n := 0
+	for _, tl := range p.levels {
+		n += tl.tiles()
+	}
+	return n
+}
+
+// buildPyramid cuts the lat/long image fixedJpg covering box into a
+// pyramid of side x side tiles. Each tile is kmzDir/tiles/z/x/y.jpg
+// with a y.kml showing it and linking to the KMLs of the tiles under
+// it, each with a Region, so apps such as Google Earth only load the
+// detail in view. Intermediate files go in tmpDir. Returns the
+// doc.kml to link to the top tile.
+func buildPyramid(ib ImageBackend, fixedJpg, tmpDir, kmzDir, name string, box []float64, side, drawingOrder int, color string) (*kmlDocument, error) {
+	width, height, err := ib.Identify(fixedJpg)
+	if err != nil {
+		return nil, err
+	}
+	p := newPyramid(width, height, side, box)
+	glog.Infof("Building %d level pyramid of %d %dx%d tiles from %v\n", p.maxZ+1, p.tiles(), side, side, fixedJpg)
+
+	// each level is reduced from the one below
+	levelJpg := fixedJpg
+	for z := p.maxZ; z >= 0; z-- {
+		if z < p.maxZ {
+			size := p.levelSize(z, width, height)
+			reduced := filepath.Join(tmpDir, fmt.Sprintf("level-%d.jpg", z))
+			if err = ib.Resize(reduced, levelJpg, size.X*size.Y); err != nil {
+				return nil, fmt.Errorf("Error reducing image to pyramid level %d: %v", z, err)
+			}
+			levelJpg = reduced
+			w, h, err := ib.Identify(levelJpg)
+			if err != nil {
+				return nil, err
+			}
+			p.setLevel(z, image.Pt(w, h))
+		}
+		if err = p.cutLevel(ib, levelJpg, tmpDir, kmzDir, z); err != nil {
+			return nil, err
+		}
+	}
+
+	for z, tl := range p.levels {
+		for y := 0; y < tl.rows; y++ {
+			for x := 0; x < tl.cols; x++ {
+				if err = p.writeTileKML(kmzDir, z, x, y, drawingOrder, color); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return &kmlDocument{
+		Name:         name,
+		NetworkLinks: []*kmlNetworkLink{{Name: name, Link: kmlLink{Href: "tiles/0/0/0.kml"}}},
+	}, nil
+}
+
+// cutLevel chops levelJpg, the image of level z, into its tiles and
+// moves them to kmzDir/tiles/z/x/y.jpg
+func (p *pyramid) cutLevel(ib ImageBackend, levelJpg, tmpDir, kmzDir string, z int) error {
+	tl := p.levels[z]
+	cropDir := filepath.Join(tmpDir, fmt.Sprintf("level-%d", z))
+	if err := os.MkdirAll(cropDir, 0755); err != nil {
+		return err
+	}
+	if err := ib.Crop(levelJpg, cropDir, "level", tl); err != nil {
+		return fmt.Errorf("Error chopping pyramid level %d into tiles: %v", z, err)
+	}
+	for x := 0; x < tl.cols; x++ {
+		dir := filepath.Join(kmzDir, "tiles", fmt.Sprint(z), fmt.Sprint(x))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < tl.tiles(); i++ {
+		x, y := i%tl.cols, i/tl.cols
+		from := tileFile(cropDir, "level", i)
+		to := filepath.Join(kmzDir, "tiles", fmt.Sprint(z), fmt.Sprint(x), fmt.Sprintf("%d.jpg", y))
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("Error moving pyramid tile: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeTileKML writes kmzDir/tiles/z/x/y.kml showing tile x,y of level
+// z when it covers half a tile's pixels or more on screen, and linking
+// to the KMLs of the tiles under it. Deeper tiles are drawn on top.
+func (p *pyramid) writeTileKML(kmzDir string, z, x, y, drawingOrder int, color string) error {
+	name := fmt.Sprintf("%d/%d/%d", z, x, y)
+	tbox := p.tileBox(z, x, y)
+	minLod := p.side / 2
+	if z == 0 {
+		minLod = 0 // always shown
+	}
+	doc := &kmlDocument{
+		Name:     name,
+		Region:   newKMLRegion(tbox, minLod),
+		Overlays: []*kmlOverlay{newKMLOverlay(name, [4]float64{tbox[north], tbox[south], tbox[east], tbox[west]}, 0, drawingOrder+z, color, fmt.Sprintf("%d.jpg", y))},
+	}
+	for _, c := range p.children(z, x, y) {
+		doc.NetworkLinks = append(doc.NetworkLinks, &kmlNetworkLink{
+			Name:   fmt.Sprintf("%d/%d/%d", z+1, c.X, c.Y),
+			Region: newKMLRegion(p.tileBox(z+1, c.X, c.Y), p.side/2),
+			Link:   kmlLink{Href: fmt.Sprintf("../../%d/%d/%d.kml", z+1, c.X, c.Y), ViewRefreshMode: "onRegion"},
+		})
+	}
+	f, err := os.Create(filepath.Join(kmzDir, "tiles", fmt.Sprint(z), fmt.Sprint(x), fmt.Sprintf("%d.kml", y)))
+	if err != nil {
+		return err
+	}
+	if err = writeKML(f, doc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPyramid(t *testing.T) {
+	p := newPyramid(1000, 300, 256, []float64{50, 49, -122, -123})
+	if p.maxZ != 2 {
+		t.Fatalf("maxZ %d, want 2", p.maxZ)
+	}
+	for z, want := range []image.Point{{250, 75}, {500, 150}, {1000, 300}} {
+		if p.sizes[z] != want {
+			t.Errorf("level %d size %v, want %v", z, p.sizes[z], want)
+		}
+	}
+	if tl := p.levels[2]; tl.cols != 4 || tl.rows != 2 {
+		t.Errorf("level 2 %dx%d tiles, want 4x2", tl.cols, tl.rows)
+	}
+
+	// every tile below the top is the child of exactly one tile
+	for z := 0; z < p.maxZ; z++ {
+		seen := map[image.Point]int{}
+		tl := p.levels[z]
+		for y := 0; y < tl.rows; y++ {
+			for x := 0; x < tl.cols; x++ {
+				for _, c := range p.children(z, x, y) {
+					seen[c]++
+				}
+			}
+		}
+		if below := p.levels[z+1].tiles(); len(seen) != below {
+			t.Errorf("level %d: %d of %d tiles are children", z+1, len(seen), below)
+		}
+		for c, n := range seen {
+			if n != 1 {
+				t.Errorf("level %d tile %v is a child %d times", z+1, c, n)
+			}
+		}
+	}
+	if c := p.children(p.maxZ, 0, 0); c != nil {
+		t.Errorf("deepest level has children %v", c)
+	}
+
+	// whole top tile is the map's box
+	if b := p.tileBox(0, 0, 0); b[north] != 50 || b[south] != 49 || b[east] != -122 || b[west] != -123 {
+		t.Errorf("top tile box %v", b)
+	}
+}
+
+func TestBuildPyramid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "map.jpg")
+	if err = writeJpg(src, image.NewGray(image.Rect(0, 0, 600, 300)), jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+	kmzDir := filepath.Join(dir, "kmz")
+	doc, err := buildPyramid(goImager{}, src, dir, kmzDir, "map", []float64{50, 49, -122, -123}, 256, 40, "bdffffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.NetworkLinks) != 1 || doc.NetworkLinks[0].Link.Href != "tiles/0/0/0.kml" {
+		t.Errorf("doc links %+v", doc.NetworkLinks)
+	}
+	// 1 tile at 150x75, 2x1 at 300x150, 3x2 at 600x300
+	for _, f := range []string{"0/0/0", "1/1/0", "2/0/1", "2/2/1"} {
+		for _, ext := range []string{".jpg", ".kml"} {
+			if _, err := os.Stat(filepath.Join(kmzDir, "tiles", f+ext)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(kmzDir, "tiles", "2", "3")); err == nil {
+		t.Errorf("level 2 has a 4th column")
+	}
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// renameCmd represents the rename command
+var renameCmd = &cobra.Command{
+	Use:   "rename",
+	Short: "Renames an image to the name-geo-anchored form the kmz and bigkmz subcommands expect",
+	Long: `Renames (or copies) an image to the name-geo-anchored form:
+
+    <map-name>_<North-lat>_<South-lat>_<East-long>_<West-long>.<fmt>
+
+so the bounding box travels with the file and cannot be lost. The
+bounding box comes from, in order of preference:
+
+  * --box N,S,E,W in decimal degrees
+  * --kmz an existing KMZ (or KML) of the map; the box enclosing its
+    GroundOverlays' LatLonBoxes is used
+  * the image's own GeoTIFF tags or world file (e.g. mymap.jgw), in
+    lat/long
+
+For example:
+
+    cutkmz rename --box 49.470628,49.336694,-122.9811,-123.132056 --name Grouse-Mountain scan.jpg
+
+creates Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+The map name defaults to the image's name. Underscores in it are
+replaced with dashes as underscores separate the parts of the name.
+Existing files are not overwritten.
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processRename(viper.GetViper(), args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz rename -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(renameCmd)
+
+	renameCmd.Flags().String("box", "", "bounding box N,S,E,W in decimal degrees.")
+	viper.BindPFlag("box", renameCmd.Flags().Lookup("box"))
+
+	renameCmd.Flags().String("kmz", "", "KMZ or KML whose GroundOverlays give the bounding box.")
+	viper.BindPFlag("kmz", renameCmd.Flags().Lookup("kmz"))
+
+	renameCmd.Flags().String("name", "", "map name. Default is the image file's name.")
+	viper.BindPFlag("name", renameCmd.Flags().Lookup("name"))
+
+	renameCmd.Flags().BoolP("copy", "c", false, "Copy the image instead of renaming it.")
+	viper.BindPFlag("copy", renameCmd.Flags().Lookup("copy"))
+
+	renameCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, renameCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// processRename renames or copies the image args to name-geo-anchored
+// file names using the "box", "kmz", "name" and "copy" from viper if
+// present.
+func processRename(v *viper.Viper, args []string) error {
+	boxFlag := v.GetString("box")
+	kmzFlag := v.GetString("kmz")
+	name := v.GetString("name")
+	copyImg := v.GetBool("copy")
+
+	if len(args) == 0 {
+		return fmt.Errorf("Image file required: must provide one or more image file path")
+	}
+	if len(args) > 1 && (boxFlag != "" || kmzFlag != "" || name != "") {
+		return fmt.Errorf("Only one image at a time can be renamed with a --box, --kmz or --name")
+	}
+	if boxFlag != "" && kmzFlag != "" {
+		return fmt.Errorf("Give either --box or --kmz, not both")
+	}
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
+
+	for _, image := range args {
+		if _, err := os.Stat(image); err != nil {
+			return err
+		}
+		var box []float64
+		base := strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+		switch {
+		case boxFlag != "":
+			if box, err = parseBox(boxFlag); err != nil {
+				return err
+			}
+		case kmzFlag != "":
+			overlays, err := readKMZOverlays(kmzFlag)
+			if err != nil {
+				return err
+			}
+			if box, err = overlaysBox(overlays); err != nil {
+				return fmt.Errorf("Error with KMZ %v: %v", kmzFlag, err)
+			}
+		default:
+			var crs int
+			if base, box, crs, err = mapBox(ib, image, 0); err != nil {
+				return fmt.Errorf("Error with image bounding box: %v", err)
+			}
+			if crs != 0 {
+				return fmt.Errorf("Image %v is in projected CRS EPSG:%d, the name-geo-anchored box must be lat/long. Use kmz or bigkmz, which reproject", image, crs)
+			}
+		}
+		if gbase, _, err := getBox(image); err == nil {
+			base = gbase // already name-geo-anchored
+		}
+		if name != "" {
+			base = name
+		}
+		newPath, err := geoAnchoredName(image, base, box)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(newPath); err == nil {
+			return fmt.Errorf("Not overwriting existing %v", newPath)
+		}
+		if copyImg {
+			err = copyFile(newPath, image)
+		} else {
+			err = os.Rename(image, newPath)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(newPath)
+	}
+	return nil
+}
+
+// parseBox parses a comma separated N,S,E,W decimal degrees bounding
+// box
+func parseBox(s string) ([]float64, error) {
+	c := strings.Split(s, ",")
+	if len(c) != 4 {
+		return nil, fmt.Errorf("Box must be 4 comma separated decimal degrees N,S,E,W, got %q", s)
+	}
+	var box []float64
+	for _, v := range c {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing box degrees: %v", err)
+		}
+		box = append(box, f)
+	}
+	return box, checkBox(box)
+}
+
+// geoAnchoredName returns the name-geo-anchored path for image with
+// the given map name and bounding box, in the same directory. It is
+// checked with getBox so the kmz & bigkmz subcommands will accept it.
+func geoAnchoredName(image, base string, box []float64) (string, error) {
+	if err := checkBox(box); err != nil {
+		return "", err
+	}
+	base = strings.Replace(base, "_", "-", -1)
+	if base == "" {
+		return "", fmt.Errorf("Map name must not be empty")
+	}
+	deg := func(f float64) string {
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0" // so getBox can tell the west long from the extension
+		}
+		return s
+	}
+	newPath := filepath.Join(filepath.Dir(image), fmt.Sprintf("%s_%s_%s_%s_%s%s", base,
+		deg(box[north]), deg(box[south]), deg(normEasting(box[east])), deg(normEasting(box[west])), filepath.Ext(image)))
+	gbase, gbox, err := getBox(newPath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot make a name-geo-anchored name for %v: %v", image, err)
+	}
+	if gbase != base || gbox[north] != box[north] || gbox[south] != box[south] {
+		return "", fmt.Errorf("Name-geo-anchored name %v does not give back map name %v and box %v", newPath, base, box)
+	}
+	return newPath, nil
+}
+
+// copyFile copies the file at src to a new file at dst
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
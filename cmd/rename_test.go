@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeoAnchoredName(t *testing.T) {
+	vals := []struct {
+		image, base string
+		box         []float64
+		want        string
+	}{
+		{"/a_b/scan.jpg", "Grouse", []float64{49.47, 49.33, -122.98, -123.13}, "/a_b/Grouse_49.47_49.33_-122.98_-123.13.jpg"},
+		{"scan.tif", "Trail_Map", []float64{50, 49, -122, -123}, "Trail-Map_50.0_49.0_-122.0_-123.0.tif"},
+		{"scan.jpg", "Dateline", []float64{10, 0, -179.5, 179.5}, "Dateline_10.0_0.0_-179.5_179.5.jpg"},
+	}
+	for _, v := range vals {
+		got, err := geoAnchoredName(v.image, v.base, v.box)
+		if err != nil {
+			t.Errorf("Unexpected error %v for %v", err, v)
+		}
+		if got != v.want {
+			t.Errorf("Wrong name %v, want %v", got, v.want)
+		}
+	}
+	if _, err := geoAnchoredName("scan.jpg", "Upside-Down", []float64{49, 50, 1, 0}); err == nil {
+		t.Errorf("Expected error for north < south")
+	}
+}
+
+func TestOverlaysBox(t *testing.T) {
+	kml := `<kml xmlns="http://www.opengis.net/kml/2.2"><Document><Folder>
+<GroundOverlay><name>a</name><drawOrder>51 </drawOrder><Icon><href>tiles/a.jpg</href></Icon>
+<LatLonBox><north>10</north><south>5 </south><east>-179</east><west>179</west></LatLonBox></GroundOverlay>
+<GroundOverlay><name>b</name><LatLonBox><north>5</north><south>0</south><east>178</east><west>177</west></LatLonBox></GroundOverlay>
+</Folder></Document></kml>`
+	overlays, err := readKMLOverlays(strings.NewReader(kml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlays) != 2 || overlays[0].DrawOrder != 51 || overlays[0].Icon.Href != "tiles/a.jpg" {
+		t.Fatalf("Wrong overlays: %+v", overlays)
+	}
+	box, err := overlaysBox(overlays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if box[north] != 10 || box[south] != 0 || box[east] != -179 || box[west] != 177 {
+		t.Errorf("Wrong box %v", box)
+	}
+}
@@ -50,17 +50,28 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cutkmz.yaml)")
+
+	RootCmd.PersistentFlags().String("backend", autoBackend, "imaging backend: auto, magick (ImageMagick), gm (GraphicsMagick), vips or go (built-in).")
+	viper.BindPFlag("backend", RootCmd.PersistentFlags().Lookup("backend"))
+}
+
+// bindFlags binds the flags of the subcommand being run to viper. Use
+// it as the PreRun of subcommands sharing flag names with others, as
+// the binding done in each subcommand's init is lost to whichever
+// init runs last.
+func bindFlags(cmd *cobra.Command, args []string) {
+	viper.BindPFlags(cmd.Flags())
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" { // enable ability to specify config file via flag
 		viper.SetConfigFile(cfgFile)
+	} else { // SetConfigName would undo SetConfigFile
+		viper.SetConfigName(".cutkmz") // name of config file (without extension)
+		viper.AddConfigPath("$HOME")   // adding home directory as first search path
 	}
-
-	viper.SetConfigName(".cutkmz") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")   // adding home directory as first search path
-	viper.AutomaticEnv()           // read in environment variables that match
+	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
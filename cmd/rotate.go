@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	nw int = iota // index into [4][2]float64 quad corners
+	ne
+	se
+	sw
+)
+
+const (
+	cornerLat int = iota // index into [2]float64 corner
+	cornerLon
+)
+
+// parseCorners parses the comma separated lat/long decimal degrees of
+// a map's four corners in NW, NE, SE, SW order, e.g.
+// "49.47,-123.14,49.48,-122.98,49.33,-122.97,49.32,-123.13"
+func parseCorners(s string) (quad [4][2]float64, err error) {
+	c := strings.Split(s, ",")
+	if len(c) != 8 {
+		return quad, fmt.Errorf("Corners must be 8 comma separated decimal degrees: lat,long of NW, NE, SE & SW corners, got %q", s)
+	}
+	for i, v := range c {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return quad, fmt.Errorf("Error parsing corner degrees: %v", err)
+		}
+		quad[i/2][i%2] = f
+	}
+	for i := range quad {
+		if quad[i][cornerLat] < -90 || quad[i][cornerLat] > 90 {
+			return quad, fmt.Errorf("Corner latitudes must be in [-90,90], got %v", quad[i][cornerLat])
+		}
+		quad[i][cornerLon] = normEasting(quad[i][cornerLon])
+	}
+	return quad, nil
+}
+
+// quadBox returns the north, south, east, west box enclosing the quad
+func quadBox(quad [4][2]float64) []float64 {
+	box := []float64{-90, 90, 0, 0}
+	var minLon, maxLon float64 // relative to NW's so crossing 180 works
+	for _, c := range quad {
+		box[north] = math.Max(box[north], c[cornerLat])
+		box[south] = math.Min(box[south], c[cornerLat])
+		rel := normEasting(c[cornerLon] - quad[nw][cornerLon])
+		minLon, maxLon = math.Min(minLon, rel), math.Max(maxLon, rel)
+	}
+	box[east] = normEasting(quad[nw][cornerLon] + maxLon)
+	box[west] = normEasting(quad[nw][cornerLon] + minLon)
+	return box
+}
+
+// subQuad returns the corners of the part of the map with the given
+// corners between fractions u0 and u1 of its width from its west
+// edge and v0 and v1 of its height from its north edge. Corners are
+// interpolated bilinearly, good for maps much smaller than the earth.
+func subQuad(quad [4][2]float64, u0, v0, u1, v1 float64) [4][2]float64 {
+	at := func(u, v float64) (c [2]float64) {
+		// longitudes relative to NW's so crossing 180 works
+		dlon := func(i int) float64 { return normEasting(quad[i][cornerLon] - quad[nw][cornerLon]) }
+		c[cornerLat] = (1-u)*(1-v)*quad[nw][cornerLat] + u*(1-v)*quad[ne][cornerLat] +
+			u*v*quad[se][cornerLat] + (1-u)*v*quad[sw][cornerLat]
+		c[cornerLon] = normEasting(quad[nw][cornerLon] + u*(1-v)*dlon(ne) + u*v*dlon(se) + (1-u)*v*dlon(sw))
+		return
+	}
+	return [4][2]float64{at(u0, v0), at(u1, v0), at(u1, v1), at(u0, v1)}
+}
+
+// rotateTileBox returns the tile's box moved so its centre is rotated
+// counter-clockwise by rotation degrees about the centre of the map's
+// box. Each tile is then also rotated about its own centre by KML's
+// LatLonBox rotation, putting the tiles back together as one rotated
+// map.
+func rotateTileBox(tbox, mapBox [4]float64, rotation float64) [4]float64 {
+	mapLat := (mapBox[north] + mapBox[south]) / 2
+	mapLon := mapBox[west] + eastDelta(mapBox[east], mapBox[west])/2
+	tileLat := (tbox[north] + tbox[south]) / 2
+	tileLon := tbox[west] + eastDelta(tbox[east], tbox[west])/2
+
+	// rotate in a plane where a degree of long is as long as one of lat
+	cosLat := math.Cos(rad(mapLat))
+	dx, dy := normEasting(tileLon-mapLon)*cosLat, tileLat-mapLat
+	sin, cos := math.Sincos(rad(rotation))
+	dLon := (dx*cos-dy*sin)/cosLat - dx/cosLat
+	dLat := dx*sin + dy*cos - dy
+
+	tbox[north] += dLat
+	tbox[south] += dLat
+	tbox[east] = normEasting(tbox[east] + dLon)
+	tbox[west] = normEasting(tbox[west] + dLon)
+	return tbox
+}
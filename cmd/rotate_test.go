@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSubQuad(t *testing.T) {
+	quad, err := parseCorners("49.5,-123.2,49.6,-122.9,49.3,-122.8,49.2,-123.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := subQuad(quad, 0, 0, 1, 1); q != quad {
+		t.Errorf("Whole quad changed: %v", q)
+	}
+	q := subQuad(quad, 0.5, 0.5, 1, 1)
+	if math.Abs(q[nw][cornerLat]-49.4) > 1e-9 || math.Abs(q[nw][cornerLon]+123) > 1e-9 || q[se] != quad[se] {
+		t.Errorf("Wrong SE quarter: %v", q)
+	}
+
+	// crossing 180
+	quad, err = parseCorners("10,179,10,-179,0,-179,0,179")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := quadBox(quad); b[east] != -179 || b[west] != 179 {
+		t.Errorf("Wrong box across 180: %v", b)
+	}
+	if q := subQuad(quad, 0.5, 0, 1, 1); q[nw][cornerLon] != 180 && q[nw][cornerLon] != -180 {
+		t.Errorf("Wrong mid long across 180: %v", q)
+	}
+}
+
+func TestRotateTileBox(t *testing.T) {
+	mapBox := [4]float64{1, -1, 1, -1}
+	tbox := [4]float64{1, -1, 1, 0.5} // east edge tile, centre 0.75 east
+	for _, v := range []struct{ rot, n, w float64 }{
+		{0, 1, 0.5},
+		{90, 1.75, -0.25},  // centre now north of map centre
+		{-90, 0.25, -0.25}, // and south
+		{180, 1, -1},
+	} {
+		r := rotateTileBox(tbox, mapBox, v.rot)
+		if math.Abs(r[north]-v.n) > 1e-3 || math.Abs(r[west]-v.w) > 1e-3 {
+			t.Errorf("Rotation %v wrong box %v", v.rot, r)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+)
+
+// defaultBlankTolerance is how much the 0-255 channels of a blank
+// tile may vary, enough for JPEG artifacts and scanner noise on white
+const defaultBlankTolerance = 12
+
+// tileLayout is how an image is cut into a grid of cols x rows tiles
+// of width x height pixels. The last column and row may be a few
+// pixels narrower or shorter.
+type tileLayout struct {
+	cols, rows    int
+	width, height int // of each tile
+}
+
+// tiles returns the number of tiles in the layout
+func (tl tileLayout) tiles() int {
+	return tl.cols * tl.rows
+}
+
+// tileRect returns the pixel rectangle of tile i, counting from the top
+// left (NW) eastwards then down a row, within an image of the given
+// bounds
+func (tl tileLayout) tileRect(i int, bounds image.Rectangle) image.Rectangle {
+	x := bounds.Min.X + (i%tl.cols)*tl.width
+	y := bounds.Min.Y + (i/tl.cols)*tl.height
+	return image.Rect(x, y, x+tl.width, y+tl.height).Intersect(bounds)
+}
+
+// tileFile returns the path in dir of tile i of baseName as
+// ImageBackend.Crop writes it. Past 999 the numbers are wider, so
+// tiles are not in order by name.
+func tileFile(dir, baseName string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_tile_%03d.jpg", baseName, i))
+}
+
+// planTiles returns the layout covering a width x height image in the
+// fewest tiles of at most maxTilePixels, e.g. 512x2048 or 1000x1048 as
+// well as 1024x1024 for 1MP, so there are no thin slivers of tiles at
+// the right and bottom edges. Of layouts with as few tiles, the one
+// with the least wasted area, then squarest tiles, is chosen.
+func planTiles(width, height, maxTilePixels int) tileLayout {
+	var best tileLayout
+	bestWaste := 0
+	for cols := 1; cols <= width; cols++ {
+		if best.cols != 0 && cols > best.tiles() {
+			break // a single row of more columns can't beat it
+		}
+		tw := (width + cols - 1) / cols
+		if tw > maxTilePixels {
+			continue
+		}
+		rows := (height + maxTilePixels/tw - 1) / (maxTilePixels / tw)
+		th := (height + rows - 1) / rows
+		// evening out the sizes can leave fewer columns or rows
+		tl := tileLayout{cols: (width + tw - 1) / tw, rows: (height + th - 1) / th, width: tw, height: th}
+		waste := tl.tiles()*tw*th - width*height
+		switch {
+		case best.cols == 0, tl.tiles() < best.tiles(),
+			tl.tiles() == best.tiles() && waste < bestWaste,
+			tl.tiles() == best.tiles() && waste == bestWaste && absInt(tw-th) < absInt(best.width-best.height):
+			best, bestWaste = tl, waste
+		}
+	}
+	return best
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// tileBudget returns the max pixel area for each of the images of the
+// given sizes so that laid out by planTiles in tiles of at most
+// maxTilePixels they make maxTiles or fewer in all. Images are
+// reduced, never enlarged, so each keeps about weights[i] times the
+// pixels per area of an image of weight 1, or the same for all if
+// weights is nil.
+func tileBudget(sizes []image.Point, weights []float64, maxTiles, maxTilePixels int) ([]int, error) {
+	if len(sizes) > maxTiles {
+		return nil, fmt.Errorf("%d images need at least %d tiles, more than the %d tile limit", len(sizes), len(sizes), maxTiles)
+	}
+	weight := func(i int) float64 {
+		if weights == nil {
+			return 1
+		}
+		return weights[i]
+	}
+	// image i is scaled by min(1, k*sqrt(weight)), starting with k
+	// large enough to leave every image whole
+	k := 0.0
+	for i := range sizes {
+		k = math.Max(k, 1/math.Sqrt(weight(i)))
+	}
+	scale := func(i int) float64 { return math.Min(1, k*math.Sqrt(weight(i))) }
+	tiles := func() (n int) {
+		for i, s := range sizes {
+			// rounded up as backends may round a pixel either way
+			w := int(math.Ceil(float64(s.X) * scale(i)))
+			h := int(math.Ceil(float64(s.Y) * scale(i)))
+			n += planTiles(w, h, maxTilePixels).tiles()
+		}
+		return
+	}
+	for tiles() > maxTiles {
+		k *= 0.98
+	}
+	budget := make([]int, len(sizes))
+	for i, s := range sizes {
+		budget[i] = int(math.Max(1, math.Floor(float64(s.X*s.Y)*scale(i)*scale(i))))
+	}
+	return budget, nil
+}
+
+// imageTileBudget is tileBudget for a single width x height image
+func imageTileBudget(width, height, maxTiles, maxTilePixels int) (int, error) {
+	budget, err := tileBudget([]image.Point{{width, height}}, nil, maxTiles, maxTilePixels)
+	if err != nil {
+		return 0, err
+	}
+	return budget[0], nil
+}
+
+// blankTile returns true if the tile image at fpath is a single
+// colour, its channels varying by no more than tolerance (0-255)
+func blankTile(fpath string, tolerance int) (bool, error) {
+	img, err := decodeImage(fpath)
+	if err != nil {
+		return false, err
+	}
+	return uniformImage(img, tolerance), nil
+}
+
+// uniformImage returns true if no channel of img varies by more than
+// tolerance (0-255). JPGs decode as YCbCr or Gray, which are checked
+// without converting each pixel to RGB.
+func uniformImage(img image.Image, tolerance int) bool {
+	b := img.Bounds()
+	if b.Empty() {
+		return true
+	}
+	var lo, hi [3]int
+	for k := range lo {
+		lo[k], hi[k] = 255, 0
+	}
+	// within returns false once channel k has varied too much
+	within := func(k int, v uint8) bool {
+		if int(v) < lo[k] {
+			lo[k] = int(v)
+		}
+		if int(v) > hi[k] {
+			hi[k] = int(v)
+		}
+		return hi[k]-lo[k] <= tolerance
+	}
+	switch m := img.(type) {
+	case *image.YCbCr:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				ci := m.COffset(x, y)
+				if !within(0, m.Y[m.YOffset(x, y)]) || !within(1, m.Cb[ci]) || !within(2, m.Cr[ci]) {
+					return false
+				}
+			}
+		}
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if !within(0, m.Pix[m.PixOffset(x, y)]) {
+					return false
+				}
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				if !within(0, uint8(r>>8)) || !within(1, uint8(g>>8)) || !within(2, uint8(bl>>8)) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanTiles(t *testing.T) {
+	tests := []struct {
+		width, height int
+		maxTilePixels int
+		tiles         int
+	}{
+		{1024, 1024, megaPixel, 1},
+		{1025, 1024, megaPixel, 2},
+		{2049, 1000, megaPixel, 2}, // 3 with 1024x1024 crops
+		{512, 4000, megaPixel, 2},
+		{5000, 4000, megaPixel, 20},
+		{3000, 2000, 262144, 23},
+		{1, 1, megaPixel, 1},
+		{100000, 1, megaPixel, 1},
+	}
+	for _, tt := range tests {
+		tl := planTiles(tt.width, tt.height, tt.maxTilePixels)
+		if tl.tiles() != tt.tiles {
+			t.Errorf("%dx%d: got %d tiles %+v, want %d", tt.width, tt.height, tl.tiles(), tl, tt.tiles)
+		}
+		if tl.width*tl.height > tt.maxTilePixels {
+			t.Errorf("%dx%d: tiles %dx%d over %d pixels", tt.width, tt.height, tl.width, tl.height, tt.maxTilePixels)
+		}
+		// tiles cover the image exactly, none empty
+		b := image.Rect(0, 0, tt.width, tt.height)
+		area := 0
+		for i := 0; i < tl.tiles(); i++ {
+			r := tl.tileRect(i, b)
+			if r.Empty() {
+				t.Errorf("%dx%d: tile %d of %+v is empty", tt.width, tt.height, i, tl)
+			}
+			area += r.Dx() * r.Dy()
+		}
+		if area != tt.width*tt.height {
+			t.Errorf("%dx%d: tiles %+v cover %d pixels", tt.width, tt.height, tl, area)
+		}
+	}
+}
+
+func TestTileBudget(t *testing.T) {
+	tests := []struct {
+		sizes    []image.Point
+		weights  []float64
+		maxTiles int
+	}{
+		{[]image.Point{{500, 400}}, nil, 1},
+		{[]image.Point{{5000, 4000}}, nil, 100},
+		{[]image.Point{{5000, 4000}}, nil, 12},
+		{[]image.Point{{2048, 2048}, {300, 200}, {1025, 10}}, nil, 4},
+		{[]image.Point{{256, 256}, {256, 256}, {256, 256}}, nil, 3},
+		{[]image.Point{{8000, 8000}, {8000, 8000}}, []float64{4, 1}, 100},
+		{[]image.Point{{3000, 3000}, {20000, 20000}}, []float64{1, 0.5}, 50},
+	}
+	for _, tt := range tests {
+		budget, err := tileBudget(tt.sizes, tt.weights, tt.maxTiles, megaPixel)
+		if err != nil {
+			t.Errorf("%v %d: unexpected error %v", tt.sizes, tt.maxTiles, err)
+			continue
+		}
+		n := 0
+		for i, s := range tt.sizes {
+			if budget[i] > s.X*s.Y {
+				t.Errorf("%v %d: image %d enlarged to %d pixels", tt.sizes, tt.maxTiles, i, budget[i])
+			}
+			scale := math.Min(1, math.Sqrt(float64(budget[i])/float64(s.X*s.Y)))
+			w, h := math.Floor(float64(s.X)*scale), math.Floor(float64(s.Y)*scale)
+			n += planTiles(int(w), int(h), megaPixel).tiles()
+		}
+		if n > tt.maxTiles {
+			t.Errorf("%v %d: budget %v makes %d tiles", tt.sizes, tt.maxTiles, budget, n)
+		}
+	}
+
+	// 4x the weight gets about 4x the pixels of the same size image
+	budget, err := tileBudget([]image.Point{{20000, 20000}, {20000, 20000}}, []float64{4, 1}, 100, megaPixel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := float64(budget[0]) / float64(budget[1]); r < 3.9 || r > 4.1 {
+		t.Errorf("weighted budget %v ratio %v, want 4", budget, r)
+	}
+	if _, err := tileBudget([]image.Point{{10, 10}, {10, 10}}, nil, 1, megaPixel); err == nil {
+		t.Errorf("expected error for more images than tiles")
+	}
+}
+
+func TestUniformImage(t *testing.T) {
+	r := image.Rect(0, 0, 64, 64)
+	rgba := image.NewRGBA(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = 250
+	}
+	gray := image.NewGray(r)
+	ycc := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	for i := range ycc.Y {
+		ycc.Y[i] = 235
+	}
+	if !uniformImage(rgba, 0) || !uniformImage(gray, 0) || !uniformImage(ycc, 0) {
+		t.Errorf("single colour images not uniform")
+	}
+	rgba.Set(10, 10, color.RGBA{240, 250, 250, 255})
+	gray.Set(63, 63, color.Gray{8})
+	ycc.Y[ycc.YOffset(5, 60)] = 245
+	if !uniformImage(rgba, 10) || !uniformImage(gray, 8) || !uniformImage(ycc, 10) {
+		t.Errorf("images within tolerance not uniform")
+	}
+	if uniformImage(rgba, 9) || uniformImage(gray, 7) || uniformImage(ycc, 9) {
+		t.Errorf("images beyond tolerance uniform")
+	}
+}
+
+func TestChopAllSkipBlank(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// detail in the top left quarter, white margins elsewhere
+	img := image.NewRGBA(image.Rect(0, 0, 2048, 2048))
+	rnd := rand.New(rand.NewSource(1))
+	for y := 0; y < 2048; y++ {
+		for x := 0; x < 2048; x++ {
+			c := color.RGBA{255, 255, 255, 255}
+			if x < 1024 && y < 1024 {
+				c = color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	src := filepath.Join(dir, "map.jpg")
+	if err = writeJpg(src, img, jpegQuality); err != nil {
+		t.Fatal(err)
+	}
+	dev := &device{name: "test", maxTiles: 8, maxTilePixels: 256 * 256, maxTileBytes: 1 << 30, drawingOrder: 51}
+	budget, err := imageTileBudget(2048, 2048, dev.maxTiles, dev.maxTilePixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, skip := range []bool{false, true} {
+		kmzDir := filepath.Join(dir, "kmz")
+		tj := &tileJob{
+			image: src, width: 2048, height: 2048, base: "map",
+			box: []float64{50, 49, -122, -123}, maxPixels: budget, dev: dev,
+			skipBlank: skip, blankTolerance: defaultBlankTolerance,
+			tmpDir: dir, kmzDir: kmzDir, tilesDir: filepath.Join(kmzDir, "tiles"),
+		}
+		if err = os.MkdirAll(tj.tilesDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		overlays, err := chopAll(goImager{}, []*tileJob{tj}, dev.maxTiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := filepath.Glob(filepath.Join(tj.tilesDir, "map_tile_*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(overlays[0]); n > dev.maxTiles || len(files) != n {
+			t.Errorf("skip %v: %d tiles, %d files, want the same and <= %d", skip, n, len(files), dev.maxTiles)
+		}
+		for _, o := range overlays[0] {
+			if _, err := os.Stat(filepath.Join(kmzDir, o.Icon.Href)); err != nil {
+				t.Errorf("skip %v: overlay %v: %v", skip, o.Name, err)
+			}
+		}
+		if skip && tj.maxPixels <= budget {
+			t.Errorf("tiles saved by skipping blanks not spent, %d pixels of %d", tj.maxPixels, budget)
+		}
+		if !skip && tj.maxPixels != budget {
+			t.Errorf("got %d pixels without skipping blanks, want %d", tj.maxPixels, budget)
+		}
+		os.RemoveAll(kmzDir)
+	}
+}
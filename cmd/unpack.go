@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/image/draw"
+)
+
+// unpackCmd represents the unpack command
+var unpackCmd = &cobra.Command{
+	Use:   "unpack",
+	Short: "Re-assembles the tiles of a KMZ into one name-geo-anchored JPG",
+	Long: `Reads the GroundOverlays in each given KMZ's doc.kml and mosaics their
+tile images back into one image using their LatLonBoxes. The image is
+written to the current directory with a name-geo-anchored name, e.g.
+
+    cutkmz unpack Grouse-Mountain.kmz
+
+creates Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+which can be fed straight back into the kmz or bigkmz subcommands, say
+for a device with a different tile limit.
+
+The finest tile resolution is kept unless --max_pixels is given.
+Overlays with higher drawOrders are drawn over lower ones and areas
+no overlay covers are white. Rotated overlays are not supported.
+
+For volunteers using OziExplorer, --ozi_map also writes a .map file
+calibrating the image in WGS 84, e.g.
+Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.map
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processUnpack(viper.GetViper(), args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz unpack -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(unpackCmd)
+
+	unpackCmd.Flags().IntP("max_pixels", "m", 0, "max pixel area, w x h (aka 'mega-pixels'), of the image. 0 means no limit.")
+	viper.BindPFlag("max_pixels", unpackCmd.Flags().Lookup("max_pixels"))
+
+	unpackCmd.Flags().String("name", "", "map name. Default is the KMZ file's name.")
+	viper.BindPFlag("name", unpackCmd.Flags().Lookup("name"))
+
+	unpackCmd.Flags().Bool("ozi_map", false, "Also write an OziExplorer .map file for the image.")
+	viper.BindPFlag("ozi_map", unpackCmd.Flags().Lookup("ozi_map"))
+
+	unpackCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, unpackCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// processUnpack mosaics the tiles of each KMZ in args into a
+// name-geo-anchored JPG. Uses "max_pixels", "name" and "ozi_map" from
+// viper if present.
+func processUnpack(v *viper.Viper, args []string) error {
+	maxPixels := v.GetInt("max_pixels")
+	name := v.GetString("name")
+
+	if len(args) == 0 {
+		return fmt.Errorf("KMZ file required: must provide one or more KMZ file path")
+	}
+	if len(args) > 1 && name != "" {
+		return fmt.Errorf("Only one KMZ at a time can be unpacked with a --name")
+	}
+	for _, kmz := range args {
+		zr, overlays, err := openKMZ(kmz)
+		if err != nil {
+			return err
+		}
+		img, box, err := mosaic(overlays, kmzFiles(&zr.Reader), maxPixels)
+		zr.Close()
+		if err != nil {
+			return fmt.Errorf("Error with KMZ %v: %v", kmz, err)
+		}
+		base := name
+		if base == "" {
+			base = strings.TrimSuffix(filepath.Base(kmz), filepath.Ext(kmz))
+		}
+		out, err := geoAnchoredName(base+".jpg", base, box)
+		if err != nil {
+			return err
+		}
+		if err = writeJpg(out, img, jpegQuality); err != nil {
+			return err
+		}
+		fmt.Println(out)
+		if v.GetBool("ozi_map") {
+			omPath := strings.TrimSuffix(out, filepath.Ext(out)) + ".map"
+			b := img.Bounds()
+			if err = writeOziMap(omPath, base, filepath.Base(out), b.Dx(), b.Dy(), boxQuad(box)); err != nil {
+				return err
+			}
+			fmt.Println(omPath)
+		}
+	}
+	return nil
+}
+
+// openKMZ opens the given KMZ and reads the GroundOverlays in all its
+// KMLs as per readKMZAllOverlays. The caller must close the returned
+// zip.ReadCloser.
+func openKMZ(kmz string) (*zip.ReadCloser, []*kmlGroundOverlay, error) {
+	zr, err := zip.OpenReader(kmz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening KMZ %v: %v", kmz, err)
+	}
+	overlays, err := readKMZAllOverlays(&zr.Reader)
+	if err != nil {
+		zr.Close()
+		return nil, nil, fmt.Errorf("Error with KMZ %v: %v", kmz, err)
+	}
+	return zr, overlays, nil
+}
+
+// decodeZipImage reads and decodes the image in the zip file entry
+func decodeZipImage(zf *zip.File) (image.Image, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding image %v: %v", zf.Name, err)
+	}
+	return img, nil
+}
+
+// mosaic draws the overlays' images from files into one image
+// covering all their LatLonBoxes, returning it and its north, south,
+// east, west box. It has the finest resolution of the overlays, or
+// less to keep it within maxPixels if that is not 0.
+func mosaic(overlays []*kmlGroundOverlay, files map[string]*zip.File, maxPixels int) (image.Image, []float64, error) {
+	box, err := overlaysBox(overlays)
+	if err != nil {
+		return nil, nil, err
+	}
+	imgs := make([]*zip.File, len(overlays))
+	latPerPix, lonPerPix := math.Inf(1), math.Inf(1)
+	for i, o := range overlays {
+		b, err := o.box()
+		if err != nil {
+			return nil, nil, err
+		}
+		if o.LatLonBox.Rotation != 0 {
+			return nil, nil, fmt.Errorf("GroundOverlay %q is rotated, which is not supported", o.Name)
+		}
+		if imgs[i] = files[path.Clean(o.Icon.Href)]; imgs[i] == nil {
+			return nil, nil, fmt.Errorf("GroundOverlay %q image %v is not in the KMZ", o.Name, o.Icon.Href)
+		}
+		r, err := imgs[i].Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg, _, err := image.DecodeConfig(r)
+		r.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading image %v: %v", o.Icon.Href, err)
+		}
+		latPerPix = math.Min(latPerPix, (b[north]-b[south])/float64(cfg.Height))
+		lonPerPix = math.Min(lonPerPix, eastDelta(b[east], b[west])/float64(cfg.Width))
+	}
+	w := eastDelta(box[east], box[west]) / lonPerPix
+	h := (box[north] - box[south]) / latPerPix
+	if maxPixels > 0 && w*h > float64(maxPixels) {
+		scale := math.Sqrt(float64(maxPixels) / (w * h))
+		w, h = w*scale, h*scale
+		lonPerPix, latPerPix = lonPerPix/scale, latPerPix/scale
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, int(math.Max(1, math.Round(w))), int(math.Max(1, math.Round(h)))))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	glog.Infof("Mosaic of %d overlays is %v pixels, box %v\n", len(overlays), dst.Bounds().Size(), box)
+
+	// stable so equal drawOrders keep document order, later on top
+	order := make([]int, len(overlays))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return overlays[order[i]].DrawOrder < overlays[order[j]].DrawOrder })
+	for _, i := range order {
+		b, _ := overlays[i].box()
+		x0 := math.Round(eastDelta(b[west], box[west]) / lonPerPix)
+		y0 := math.Round((box[north] - b[north]) / latPerPix)
+		x1 := x0 + math.Round(eastDelta(b[east], b[west])/lonPerPix)
+		y1 := y0 + math.Round((b[north]-b[south])/latPerPix)
+		img, err := decodeZipImage(imgs[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		r := image.Rect(int(x0), int(y0), int(x1), int(y1))
+		if r.Size() == img.Bounds().Size() {
+			draw.Draw(dst, r, img, img.Bounds().Min, draw.Over)
+		} else {
+			draw.CatmullRom.Scale(dst, r, img, img.Bounds(), draw.Over, nil)
+		}
+	}
+	return dst, box, nil
+}
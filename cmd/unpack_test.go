@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestUnpackRoundTrip(t *testing.T) {
+	dir, src, v := writeTestMap(t, 1500, 1200)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	v.Set("max_tiles", 5)
+	if err = process(v, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(src); err != nil { // so only the unpacked map is Sector_*.jpg
+		t.Fatal(err)
+	}
+	if err = processUnpack(viper.New(), []string{"Sector.kmz"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := filepath.Glob("Sector_*.jpg")
+	if err != nil || len(out) != 1 {
+		t.Fatalf("unpacked %v, %v", out, err)
+	}
+	base, box, err := getBox(out[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{50, 49, -122, -123}; base != "Sector" || !boxNear(box, want, 1e-9) {
+		t.Errorf("unpacked %v, want box %v", out[0], want)
+	}
+	img, err := decodeImage(out[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := img.Bounds().Size(); s != image.Pt(1500, 1200) {
+		t.Errorf("unpacked image is %v, want 1500x1200", s)
+	}
+	checkColor(t, out[0], img, image.Pt(375, 300), nw)
+	checkColor(t, out[0], img, image.Pt(1125, 300), ne)
+	checkColor(t, out[0], img, image.Pt(1125, 900), se)
+	checkColor(t, out[0], img, image.Pt(375, 900), sw)
+}
+
+func TestMosaicDrawOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the east overlay is first in the KML but drawn on top of the
+	// west one where they overlap, between -123 and -122.5
+	overlay := func(name, href string, drawOrder, rotation, east, west string) string {
+		return `<GroundOverlay><name>` + name + `</name><drawOrder>` + drawOrder + `</drawOrder><Icon><href>` + href + `</href></Icon>
+<LatLonBox><north>50</north><south>49</south><east>` + east + `</east><west>` + west + `</west><rotation>` + rotation + `</rotation></LatLonBox></GroundOverlay>`
+	}
+	kml := func(overlays ...string) []byte {
+		s := `<?xml version="1.0" encoding="UTF-8"?><kml xmlns="http://www.opengis.net/kml/2.2"><Document>`
+		for _, o := range overlays {
+			s += o
+		}
+		return []byte(s + `</Document></kml>`)
+	}
+	kmz := filepath.Join(dir, "layers.kmz")
+	writeTestKMZ(t, kmz, map[string][]byte{
+		"doc.kml": kml(overlay("east", "east.jpg", "60", "0", "-122", "-123"),
+			overlay("west", "west.jpg", "50", "0", "-122.5", "-123.5")),
+		"east.jpg": testJpg(t, 100, 100, testMapColors[nw]),
+		"west.jpg": testJpg(t, 100, 100, testMapColors[se]),
+	})
+	zr, overlays, err := openKMZ(kmz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	img, box, err := mosaic(overlays, kmzFiles(&zr.Reader), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{50, 49, -122, -123.5}; !boxNear(box, want, 1e-9) {
+		t.Errorf("mosaic box %v, want %v", box, want)
+	}
+	if s := img.Bounds().Size(); s != image.Pt(150, 100) {
+		t.Fatalf("mosaic is %v, want 150x100", s)
+	}
+	checkColor(t, "west only", img, image.Pt(25, 50), se)
+	checkColor(t, "overlap", img, image.Pt(75, 50), nw)
+	checkColor(t, "east only", img, image.Pt(125, 50), nw)
+
+	writeTestKMZ(t, kmz, map[string][]byte{
+		"doc.kml":  kml(overlay("turned", "east.jpg", "60", "10", "-122", "-123")),
+		"east.jpg": testJpg(t, 100, 100, testMapColors[nw]),
+	})
+	zr2, overlays, err := openKMZ(kmz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr2.Close()
+	if _, _, err = mosaic(overlays, kmzFiles(&zr2.Reader), 0); err == nil {
+		t.Errorf("expected error for a rotated overlay")
+	}
+}
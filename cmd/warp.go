@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// warpEdgeSteps is how many points along each edge of a projected map
+// are converted to find its lat/long bounding box
+const warpEdgeSteps = 256
+
+// warpToLatLong reprojects inFile, whose pixels are in the given
+// projected CRS covering srcBox (north, south, east, west in CRS
+// units), into the equirectangular lat/long grid GroundOverlays
+// assume and writes it as a JPG to outFile. About the same number of
+// pixels are kept. Areas outside the source map are white. Returns
+// outFile's lat/long bounding box. The warp is done here in Go, not by
+// the ImageBackend, with the source and output both held as RGBA, so
+// needs about 8 bytes per source pixel.
+func warpToLatLong(outFile, inFile string, srcBox []float64, crs int) ([]float64, error) {
+	p, err := newProjection(crs)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeImage(inFile)
+	if err != nil {
+		return nil, err
+	}
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	img = nil
+
+	box := latLongBounds(p, srcBox)
+	// the source's own longitude at its centre, so lons over the
+	// antimeridian go to the projection on the source's side of it
+	lonC, _ := p.inverse((srcBox[east]+srcBox[west])/2, (srcBox[north]+srcBox[south])/2)
+	glog.Infof("Warping %v from EPSG:%d box %v to lat/long box %v\n", inFile, crs, srcBox, box)
+
+	// pixels about square on the ground
+	midLat := rad((box[north] + box[south]) / 2)
+	aspect := eastDelta(box[east], box[west]) * math.Cos(midLat) / (box[north] - box[south])
+	area := float64(src.Bounds().Dx() * src.Bounds().Dy())
+	h := int(math.Max(1, math.Round(math.Sqrt(area/aspect))))
+	w := int(math.Max(1, math.Round(aspect*float64(h))))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	latPerPix := (box[north] - box[south]) / float64(h)
+	lonPerPix := eastDelta(box[east], box[west]) / float64(w)
+	colPerX := float64(src.Bounds().Dx()) / (srcBox[east] - srcBox[west])
+	rowPerY := float64(src.Bounds().Dy()) / (srcBox[north] - srcBox[south])
+
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				lat := box[north] - (float64(y)+0.5)*latPerPix
+				for x := 0; x < w; x++ {
+					lon := box[west] + (float64(x)+0.5)*lonPerPix
+					px, py := p.forward(lonC+normEasting(lon-lonC), lat)
+					c, ok := bilinear(src, (px-srcBox[west])*colPerX-0.5, (srcBox[north]-py)*rowPerY-0.5)
+					if !ok {
+						c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+					}
+					dst.SetRGBA(x, y, c)
+				}
+			}
+		}()
+	}
+	for y := 0; y < h; y++ {
+		rows <- y
+	}
+	close(rows)
+	wg.Wait()
+	return box, writeJpg(outFile, dst, jpegQuality)
+}
+
+// latLongBounds returns the lat/long bounding box (north, south,
+// east, west) enclosing the given projected box. Edges of projected
+// boxes are usually curves in lat/long, so points along them all are
+// checked, not just the corners. Longitudes are taken relative to the
+// box's centre so maps over the antimeridian get a narrow box with
+// east < west, not one around the world.
+func latLongBounds(p projection, srcBox []float64) []float64 {
+	lon0, _ := p.inverse((srcBox[east]+srcBox[west])/2, (srcBox[north]+srcBox[south])/2)
+	lon0 = normEasting(lon0)
+	var maxDE, minDW float64 // east & west of lon0
+	box := []float64{-90, 90, 0, 0}
+	add := func(x, y float64) {
+		lon, lat := p.inverse(x, y)
+		d := normEasting(lon - lon0)
+		box[north] = math.Max(box[north], lat)
+		box[south] = math.Min(box[south], lat)
+		maxDE = math.Max(maxDE, d)
+		minDW = math.Min(minDW, d)
+	}
+	for i := 0; i <= warpEdgeSteps; i++ {
+		f := float64(i) / warpEdgeSteps
+		x := srcBox[west] + f*(srcBox[east]-srcBox[west])
+		y := srcBox[south] + f*(srcBox[north]-srcBox[south])
+		add(x, srcBox[north])
+		add(x, srcBox[south])
+		add(srcBox[west], y)
+		add(srcBox[east], y)
+	}
+	box[east] = normEasting(lon0 + maxDE)
+	box[west] = normEasting(lon0 + minDW)
+	return box
+}
+
+// bilinear returns the colour at the fractional pixel position x, y
+// in img, blending the four pixels around it. False if the position
+// is outside img.
+func bilinear(img *image.RGBA, x, y float64) (color.RGBA, bool) {
+	b := img.Bounds()
+	if x < -0.5 || y < -0.5 || x > float64(b.Dx())-0.5 || y > float64(b.Dy())-0.5 {
+		return color.RGBA{}, false
+	}
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	var sum [4]float64
+	for _, c := range []struct {
+		x, y int
+		wt   float64
+	}{
+		{x0, y0, (1 - fx) * (1 - fy)},
+		{x0 + 1, y0, fx * (1 - fy)},
+		{x0, y0 + 1, (1 - fx) * fy},
+		{x0 + 1, y0 + 1, fx * fy},
+	} {
+		i := img.PixOffset(clamp(c.x, b.Dx())+b.Min.X, clamp(c.y, b.Dy())+b.Min.Y)
+		for k := 0; k < 4; k++ {
+			sum[k] += c.wt * float64(img.Pix[i+k])
+		}
+	}
+	return color.RGBA{uint8(sum[0] + 0.5), uint8(sum[1] + 0.5), uint8(sum[2] + 0.5), uint8(sum[3] + 0.5)}, true
+}
+
+// latLongMap returns the name, lat/long image and box of the given
+// map image, found as per mapBox. Maps in a projected CRS are warped
+// to lat/long in tmpDir.
+func latLongMap(ib ImageBackend, tmpDir, image string, srcCRS int) (base, img string, box []float64, err error) {
+	base, box, crs, err := mapBox(ib, image, srcCRS)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Error with image bounding box: %v", err)
+	}
+	if crs == 0 {
+		return base, image, box, nil
+	}
+	img = filepath.Join(tmpDir, "warped.jpg")
+	if box, err = warpToLatLong(img, image, box, crs); err != nil {
+		return "", "", nil, fmt.Errorf("Error reprojecting image to lat/long: %v", err)
+	}
+	return base, img, box, nil
+}
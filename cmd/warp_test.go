@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLatLongBounds(t *testing.T) {
+	// UTM zone 60 from about 179E over the antimeridian to 179W
+	p, err := newProjection(32660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := latLongBounds(p, []float64{5550000, 5500000, 780000, 650000})
+	if box[west] < 178.5 || box[west] > 179.5 || box[east] < -179.5 || box[east] > -178.5 {
+		t.Errorf("got box %v, want about 179E to 179W", box)
+	}
+	if w := eastDelta(box[east], box[west]); w > 3 {
+		t.Errorf("box %v is %v degrees wide, want under 3", box, w)
+	}
+
+	// Web Mercator x past 180 the same
+	p, _ = newProjection(epsgWebMercator)
+	box = latLongBounds(p, []float64{6500000, 6400000, 20100000, 19900000})
+	if box[west] < 178 || box[west] > 179 || box[east] < -180 || box[east] > -179 {
+		t.Errorf("got box %v, want about 178.8E to 179.4W", box)
+	}
+}
+
+func TestWarpToLatLong(t *testing.T) {
+	for _, tt := range []struct {
+		crs    int
+		srcBox []float64
+	}{
+		{32610, []float64{5480000, 5450000, 520000, 480000}}, // UTM 10N by Vancouver
+		{32660, []float64{5550000, 5500000, 780000, 650000}}, // over the antimeridian
+	} {
+		dir, src, _ := writeTestMap(t, 400, 300)
+		defer os.RemoveAll(dir)
+		out := filepath.Join(dir, "warped.jpg")
+		box, err := warpToLatLong(out, src, tt.srcBox, tt.crs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := newProjection(tt.crs)
+		if want := latLongBounds(p, tt.srcBox); !boxNear(box, want, 1e-9) {
+			t.Errorf("EPSG:%d warped box %v, want %v", tt.crs, box, want)
+		}
+		img, err := decodeImage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		if w*h < 400*300*9/10 || w*h > 400*300*11/10 {
+			t.Errorf("EPSG:%d warped to %dx%d, want about 120000 pixels", tt.crs, w, h)
+		}
+
+		// points 5% in from each corner of the source land in its colour
+		for q, f := range [4][2]float64{nw: {0.05, 0.05}, ne: {0.95, 0.05}, se: {0.95, 0.95}, sw: {0.05, 0.95}} {
+			x := tt.srcBox[west] + f[0]*(tt.srcBox[east]-tt.srcBox[west])
+			y := tt.srcBox[north] - f[1]*(tt.srcBox[north]-tt.srcBox[south])
+			lon, lat := p.inverse(x, y)
+			px := int(float64(w) * eastDelta(lon, box[west]) / eastDelta(box[east], box[west]))
+			py := int(float64(h) * (box[north] - lat) / (box[north] - box[south]))
+			checkColor(t, "warped", img, image.Pt(px, py), q)
+		}
+	}
+}
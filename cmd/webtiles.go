@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+// webTileSize is the side in pixels of Web Mercator tiles
+const webTileSize = 256
+
+// maxWebZoom is the deepest zoom level web tiles are made for
+const maxWebZoom = 22
+
+// maxWebLat is the latitude Web Mercator tiles stop at, north and
+// south, making zoom 0 square
+const maxWebLat = 85.0511287798066
+
+// webTile is tile x,y of zoom level z in the XYZ scheme: x counting
+// east from 180 degrees west, y south from maxWebLat
+type webTile struct {
+	z, x, y int
+}
+
+// webTileXY returns the fractional x,y of the zoom z tile holding
+// lon,lat
+func webTileXY(lon, lat float64, z int) (x, y float64) {
+	mx, my := webMercator{}.forward(lon, math.Max(-maxWebLat, math.Min(maxWebLat, lat)))
+	half := math.Pi * wgs84.a // of the world's width in metres
+	n := float64(int(1) << uint(z))
+	return (mx + half) / (2 * half) * n, (half - my) / (2 * half) * n
+}
+
+// webTileLonLat returns the lon,lat at the fractional x,y of zoom z
+func webTileLonLat(x, y float64, z int) (lon, lat float64) {
+	half := math.Pi * wgs84.a
+	n := float64(int(1) << uint(z))
+	return webMercator{}.inverse(x/n*2*half-half, half-y/n*2*half)
+}
+
+// webTiles returns the tiles of zoom z covering the lat/long box, x
+// wrapping around at 180 degrees
+func webTiles(box []float64, z int) []webTile {
+	n := 1 << uint(z)
+	x0, y0 := webTileXY(box[west], box[north], z)
+	x1, y1 := webTileXY(box[west]+eastDelta(box[east], box[west]), box[south], z)
+	lastX := int(math.Max(math.Ceil(x1)-1, math.Floor(x0)))
+	lastY := int(math.Max(math.Ceil(y1)-1, math.Floor(y0)))
+	var tiles []webTile
+	for y := int(math.Floor(y0)); y <= lastY && y < n; y++ {
+		for x := int(math.Floor(x0)); x <= lastX && x < int(math.Floor(x0))+n; x++ {
+			tiles = append(tiles, webTile{z, x % n, y})
+		}
+	}
+	return tiles
+}
+
+// boxCenter returns the long, lat of the middle of the lat/long box
+func boxCenter(box []float64) (lon, lat float64) {
+	return normEasting(box[west] + eastDelta(box[east], box[west])/2), (box[north] + box[south]) / 2
+}
+
+// webZooms returns the zoom levels the map of the given pixel width
+// covering box is best shown at: the shallowest with the whole map's
+// width in one tile, and the deepest with at least the image's
+// resolution
+func webZooms(width int, box []float64) (minZ, maxZ int) {
+	degPerPix := eastDelta(box[east], box[west]) / float64(width)
+	maxZ = int(math.Ceil(math.Log2(360 / (webTileSize * degPerPix))))
+	maxZ = int(math.Max(0, math.Min(maxWebZoom, float64(maxZ))))
+	minZ = int(math.Max(0, math.Floor(math.Log2(360/eastDelta(box[east], box[west])))))
+	if minZ > maxZ {
+		minZ = maxZ
+	}
+	return minZ, maxZ
+}
+
+// checkZooms returns an error if minZ to maxZ is not a zoom range
+// tiles can be made for
+func checkZooms(minZ, maxZ int) error {
+	if minZ < 0 || maxZ > maxWebZoom || minZ > maxZ {
+		return fmt.Errorf("Zoom levels must be in [0,%d] with min zoom no more than max zoom, got %d to %d", maxWebZoom, minZ, maxZ)
+	}
+	return nil
+}
+
+// zoomFlags returns the "min_zoom" and "max_zoom" zoom range, either
+// defaulting to that of webZooms for the map of the given width
+func zoomFlags(v *viper.Viper, width int, box []float64) (minZ, maxZ int, err error) {
+	minZ, maxZ = webZooms(width, box)
+	if z := v.GetInt("min_zoom"); z >= 0 {
+		minZ = z
+		if maxZ < minZ && v.GetInt("max_zoom") < 0 {
+			maxZ = minZ
+		}
+	}
+	if z := v.GetInt("max_zoom"); z >= 0 {
+		maxZ = z
+		if minZ > maxZ && v.GetInt("min_zoom") < 0 {
+			minZ = maxZ
+		}
+	}
+	return minZ, maxZ, checkZooms(minZ, maxZ)
+}
+
+// webTileFormats are the tile image formats renderWebTiles can write
+var webTileFormats = []string{"png", "jpg"}
+
+// validWebTileFormat returns true if format is one of webTileFormats
+func validWebTileFormat(format string) bool {
+	for _, f := range webTileFormats {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// renderWebTiles renders the lat/long image img covering box into
+// the Web Mercator tiles of zoom levels minZ to maxZ, deepest first,
+// and calls put with each tile encoded as format. Each level is drawn
+// from the image reduced to about its resolution, made in tmpDir, a
+// band of it for each row of tiles so the whole of a large map is not
+// held in memory. Tiles the map doesn't reach are not put; areas of those it does but
+// the map doesn't cover are transparent in PNGs, white in JPGs.
+// Returns the number of tiles put.
+func renderWebTiles(ib ImageBackend, img, tmpDir string, box []float64, minZ, maxZ int, format string, put func(t webTile, b []byte) error) (int, error) {
+	width, height, err := ib.Identify(img)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	levelImg := img
+	for z := maxZ; z >= minZ; z-- {
+		// reduce the image to about the pixels the map has at this zoom
+		x0, y0 := webTileXY(box[west], box[north], z)
+		x1, y1 := webTileXY(box[west]+eastDelta(box[east], box[west]), box[south], z)
+		area := (x1 - x0) * (y1 - y0) * webTileSize * webTileSize
+		if area < float64(width*height) {
+			reduced := filepath.Join(tmpDir, fmt.Sprintf("zoom-%d.jpg", z))
+			if err = ib.Resize(reduced, levelImg, int(math.Max(1, area))); err != nil {
+				return count, fmt.Errorf("Error reducing image for zoom %d: %v", z, err)
+			}
+			levelImg = reduced
+			if width, height, err = ib.Identify(levelImg); err != nil {
+				return count, err
+			}
+		}
+		tiles := webTiles(box, z)
+		glog.Infof("Rendering %d tiles of zoom %d from %dx%d %v\n", len(tiles), z, width, height, levelImg)
+		var band *image.RGBA
+		var bandBox []float64
+		bandY := -1
+		for _, t := range tiles {
+			if t.y != bandY { // tiles go row by row
+				if band, bandBox, err = webTileBand(ib, levelImg, tmpDir, width, height, box, t); err != nil {
+					return count, err
+				}
+				bandY = t.y
+			}
+			if band == nil {
+				continue
+			}
+			tile, ok := renderWebTile(band, bandBox, t, x0)
+			if !ok {
+				continue
+			}
+			b, err := encodeWebTile(tile, format)
+			if err != nil {
+				return count, err
+			}
+			if err = put(t, b); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// webTileBand returns the band of rows of the width x height levelImg,
+// covering box, that the row of tiles t is in, with a pixel more above
+// and below for blending, and the band's box. The band is cut out by
+// the ImageBackend so only it, not the whole level, is decoded here.
+// Nil if the row of tiles misses the image.
+func webTileBand(ib ImageBackend, levelImg, tmpDir string, width, height int, box []float64, t webTile) (*image.RGBA, []float64, error) {
+	_, top := webTileLonLat(0, float64(t.y), t.z)
+	_, bottom := webTileLonLat(0, float64(t.y+1), t.z)
+	latPerPix := (box[north] - box[south]) / float64(height)
+	r := image.Rect(0, int(math.Floor((box[north]-top)/latPerPix))-1, width, int(math.Ceil((box[north]-bottom)/latPerPix))+1)
+	if r = r.Intersect(image.Rect(0, 0, width, height)); r.Empty() {
+		return nil, nil, nil
+	}
+	bandImg := filepath.Join(tmpDir, "band.jpg")
+	if err := ib.Extract(bandImg, levelImg, r); err != nil {
+		return nil, nil, fmt.Errorf("Error cutting out row %d of zoom %d: %v", t.y, t.z, err)
+	}
+	src, err := decodeImage(bandImg)
+	if err != nil {
+		return nil, nil, err
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+	bandBox := []float64{box[north] - float64(r.Min.Y)*latPerPix, box[north] - float64(r.Max.Y)*latPerPix, box[east], box[west]}
+	return rgba, bandBox, nil
+}
+
+// renderWebTile returns tile t drawn from src, which covers box and
+// starts at fractional tile x0 of t's zoom. False if none of the tile
+// is covered.
+func renderWebTile(src *image.RGBA, box []float64, t webTile, x0 float64) (*image.RGBA, bool) {
+	dst := image.NewRGBA(image.Rect(0, 0, webTileSize, webTileSize))
+	latPerPix := (box[north] - box[south]) / float64(src.Bounds().Dy())
+	lonPerPix := eastDelta(box[east], box[west]) / float64(src.Bounds().Dx())
+
+	// keep x unwrapped from the map's west edge so crossing 180 works
+	n := 1 << uint(t.z)
+	tx := float64(t.x)
+	for tx+1 <= x0 {
+		tx += float64(n)
+	}
+
+	rows := make(chan int)
+	covered := make([]bool, webTileSize)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for py := range rows {
+				_, lat := webTileLonLat(0, float64(t.y)+(float64(py)+0.5)/webTileSize, t.z)
+				for px := 0; px < webTileSize; px++ {
+					lon, _ := webTileLonLat(tx+(float64(px)+0.5)/webTileSize, 0, t.z)
+					c, ok := bilinear(src, eastDelta(lon, box[west])/lonPerPix-0.5, (box[north]-lat)/latPerPix-0.5)
+					if ok {
+						dst.SetRGBA(px, py, c)
+						covered[py] = true
+					}
+				}
+			}
+		}()
+	}
+	for py := 0; py < webTileSize; py++ {
+		rows <- py
+	}
+	close(rows)
+	wg.Wait()
+	for _, c := range covered {
+		if c {
+			return dst, true
+		}
+	}
+	return nil, false
+}
+
+// encodeWebTile returns the tile encoded as a png or jpg, the latter
+// flattened onto white
+func encodeWebTile(tile *image.RGBA, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	if format == "jpg" {
+		flat := image.NewRGBA(tile.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), tile, tile.Bounds().Min, draw.Over)
+		if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if err := png.Encode(&buf, tile); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
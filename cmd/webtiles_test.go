@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestWebTileXY(t *testing.T) {
+	x, y := webTileXY(0, 0, 1)
+	if math.Abs(x-1) > 1e-9 || math.Abs(y-1) > 1e-9 {
+		t.Errorf("0,0 at zoom 1 is tile %v,%v, want 1,1", x, y)
+	}
+	x, y = webTileXY(-180, maxWebLat, 3)
+	if math.Abs(x) > 1e-9 || math.Abs(y) > 1e-9 {
+		t.Errorf("NW corner is tile %v,%v, want 0,0", x, y)
+	}
+	x, y = webTileXY(-123.1, 49.3, 12)
+	lon, lat := webTileLonLat(x, y, 12)
+	if math.Abs(lon+123.1) > 1e-9 || math.Abs(lat-49.3) > 1e-9 {
+		t.Errorf("got back %v,%v", lon, lat)
+	}
+}
+
+func TestWebTiles(t *testing.T) {
+	// crossing 180 degrees
+	got := webTiles([]float64{10, -10, -175, 175}, 2)
+	want := []webTile{{2, 3, 1}, {2, 0, 1}, {2, 3, 2}, {2, 0, 2}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+	if got := webTiles([]float64{50, 49, -122, -123}, 0); len(got) != 1 {
+		t.Errorf("zoom 0 got %v", got)
+	}
+}
+
+func TestWebZooms(t *testing.T) {
+	// 0.001 degrees a pixel needs zoom 11's 0.00069
+	minZ, maxZ := webZooms(1000, []float64{50, 49, -122, -123})
+	if minZ != 8 || maxZ != 11 {
+		t.Errorf("got zooms %d to %d, want 8 to 11", minZ, maxZ)
+	}
+	if err := checkZooms(5, 4); err == nil {
+		t.Errorf("expected error for min zoom > max zoom")
+	}
+}
+
+// testMapColors are the colours of the NW, NE, SE & SW quarters of the
+// map writeTestMap writes, far enough apart to survive JPEG compression
+var testMapColors = [4]color.RGBA{
+	nw: {255, 0, 0, 255},
+	ne: {0, 255, 0, 255},
+	se: {0, 0, 255, 255},
+	sw: {255, 255, 0, 255},
+}
+
+// writeTestMap writes a width x height Sector_50_49_-122_-123.0.jpg,
+// its quarters coloured as per testMapColors, to a new temporary dir
+// the caller must remove. Returns the dir, the map's path and a viper
+// using the go backend.
+func writeTestMap(t *testing.T, width, height int) (dir, src string, v *viper.Viper) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, r := range [4]image.Rectangle{
+		nw: image.Rect(0, 0, width/2, height/2),
+		ne: image.Rect(width/2, 0, width, height/2),
+		se: image.Rect(width/2, height/2, width, height),
+		sw: image.Rect(0, height/2, width/2, height),
+	} {
+		draw.Draw(img, r, image.NewUniform(testMapColors[i]), image.Point{}, draw.Src)
+	}
+	src = filepath.Join(dir, "Sector_50_49_-122_-123.0.jpg")
+	if err = writeJpg(src, img, jpegQuality); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	v = viper.New()
+	v.Set("backend", goBackend)
+	return dir, src, v
+}
+
+// checkColor reports an error if the pixel of img at p is not within
+// 40 a channel of the test map's colour of the given quarter
+func checkColor(t *testing.T, what string, img image.Image, p image.Point, quarter int) {
+	t.Helper()
+	want := testMapColors[quarter]
+	r, g, b, _ := img.At(p.X, p.Y).RGBA()
+	for i, c := range [3]uint32{r >> 8, g >> 8, b >> 8} {
+		w := [3]uint8{want.R, want.G, want.B}[i]
+		if int(c)-int(w) > 40 || int(w)-int(c) > 40 {
+			t.Errorf("%v pixel %v is %v,%v,%v, want %v", what, p, r>>8, g>>8, b>>8, want)
+			return
+		}
+	}
+}
+
+// webTilePixel returns the web tile of zoom z the lon, lat is in and
+// its pixel there
+func webTilePixel(lon, lat float64, z int) (webTile, image.Point) {
+	x, y := webTileXY(lon, lat, z)
+	tile := webTile{z, int(x), int(y)}
+	return tile, image.Pt(int((x-math.Floor(x))*webTileSize), int((y-math.Floor(y))*webTileSize))
+}
+
+func TestProcessXYZ(t *testing.T) {
+	dir, src, v := writeTestMap(t, 1000, 500)
+	defer os.RemoveAll(dir)
+	v.Set("min_zoom", -1)
+	v.Set("max_zoom", 9)
+	v.Set("tms", true)
+	v.Set("format", "png")
+	v.Set("out", filepath.Join(dir, "tiles"))
+	if err := processXYZ(v, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a point in the NW and one in the SE quarter, at zoom 9 and with
+	// TMS rows counting from the south
+	for _, pt := range []struct {
+		lon, lat float64
+		quarter  int
+	}{{-122.8, 49.8, nw}, {-122.2, 49.2, se}} {
+		tile, p := webTilePixel(pt.lon, pt.lat, 9)
+		fpath := filepath.Join(dir, "tiles", "9", strconv.Itoa(tile.x), strconv.Itoa(1<<9-1-tile.y)+".png")
+		f, err := os.Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkColor(t, fpath, img, p, pt.quarter)
+	}
+
+	// -122.5,49.5 is in tile 40,87 of zoom 8, 168 from the south
+	f, err := os.Open(filepath.Join(dir, "tiles", "8", "40", "168.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != webTileSize || img.Bounds().Dy() != webTileSize {
+		t.Errorf("tile is %v", img.Bounds())
+	}
+	if _, err = os.Stat(filepath.Join(dir, "tiles", "10")); err == nil {
+		t.Errorf("made tiles deeper than max zoom")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "tiles", "tilejson.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tj tileJSON
+	if err = json.Unmarshal(b, &tj); err != nil {
+		t.Fatal(err)
+	}
+	if tj.Name != "Sector" || tj.Scheme != "tms" || tj.MinZoom != 8 || tj.MaxZoom != 9 || tj.Tiles[0] != "{z}/{x}/{y}.png" {
+		t.Errorf("tilejson %+v", tj)
+	}
+}
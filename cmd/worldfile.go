@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// worldFile holds the six affine parameters of an ESRI world file
+// that map pixel column & row to map x & y:
+//
+//	x = A*col + B*row + C
+//	y = D*col + E*row + F
+//
+// C & F are the centre of the top left pixel.
+type worldFile struct {
+	a, d, b, e, c, f float64 // in world file line order
+}
+
+// findWorldFile returns the path of the world file sidecar for the
+// given image, or "" if there is none. For mymap.jpg it looks for
+// mymap.jgw, mymap.jpgw and mymap.wld, in upper case too.
+func findWorldFile(image string) string {
+	ext := filepath.Ext(image)
+	if len(ext) < 3 {
+		return ""
+	}
+	stem := strings.TrimSuffix(image, ext)
+	ext = strings.ToLower(ext)
+	for _, wext := range []string{ext[:2] + ext[len(ext)-1:] + "w", ext + "w", ".wld"} {
+		for _, p := range []string{stem + wext, stem + strings.ToUpper(wext)} {
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// readWorldFile parses the six lines of the given world file
+func readWorldFile(fpath string) (*worldFile, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p []float64
+	s := bufio.NewScanner(f)
+	for s.Scan() && len(p) < 6 {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(l, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing world file %v line %d: %v", fpath, len(p)+1, err)
+		}
+		p = append(p, v)
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	if len(p) != 6 {
+		return nil, fmt.Errorf("World file %v must have 6 lines of numbers, found %d", fpath, len(p))
+	}
+	return &worldFile{p[0], p[1], p[2], p[3], p[4], p[5]}, nil
+}
+
+// box returns the lat/long bounding box in decimal degrees, in
+// north, south, east, west order, of an image of the given pixel
+// width and height positioned by the world file. The world file's
+// coordinates must be decimal degrees and the image north-up.
+func (wf *worldFile) box(width, height int) ([]float64, error) {
+	if wf.b != 0 || wf.d != 0 {
+		return nil, fmt.Errorf("Rotated world files are not supported")
+	}
+	if wf.a <= 0 || wf.e >= 0 {
+		return nil, fmt.Errorf("World file pixel size must be positive in x and negative in y, got %v and %v", wf.a, wf.e)
+	}
+	box := make([]float64, 4)
+	// C & F are pixel centres; the box is the outer pixel edges
+	box[west] = wf.c - wf.a/2
+	box[north] = wf.f - wf.e/2
+	box[east] = box[west] + wf.a*float64(width)
+	box[south] = box[north] + wf.e*float64(height)
+	return box, nil
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"archive/zip"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestWorldFileBox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := filepath.Join(dir, "mymap.jpg")
+	if findWorldFile(img) != "" {
+		t.Errorf("Found world file where there is none")
+	}
+	wfPath := filepath.Join(dir, "mymap.JGW")
+	wfText := "0.001\n0\n0\n-0.0005\n-123.1305\n49.47025\n"
+	if err = ioutil.WriteFile(wfPath, []byte(wfText), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p := findWorldFile(img); p != wfPath {
+		t.Fatalf("Wrong world file: %q", p)
+	}
+	wf, err := readWorldFile(wfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := wf.box(150, 280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [4]float64{49.4705, 49.3305, -122.981, -123.131}
+	for i := range want {
+		if math.Abs(box[i]-want[i]) > 1e-9 {
+			t.Errorf("Wrong box edge %d: %v, want %v", i, box[i], want[i])
+		}
+	}
+
+	wf.b = 0.0001
+	if _, err = wf.box(150, 280); err == nil {
+		t.Errorf("Expected error for rotated world file")
+	}
+}
+
+func TestBigKMZWorldFilePNG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cutkmz-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create("mymap.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(f, image.NewGray(image.Rect(0, 0, 150, 280))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err = ioutil.WriteFile("mymap.pgw", []byte("0.001\n0\n0\n-0.0005\n-123.1305\n49.47025\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.Set("backend", goBackend)
+	if err = processBig(v, []string{"mymap.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the PNG is re-encoded, not copied into a .jpg as is
+	zr, err := zip.OpenReader("mymap-big.kmz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	zf := kmzFiles(&zr.Reader)["tiles/mymap_tile_000.jpg"]
+	if zf == nil {
+		t.Fatalf("no tile in the KMZ")
+	}
+	r, err := zf.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, format, err := image.DecodeConfig(r); err != nil || format != "jpeg" {
+		t.Errorf("tile is %q, %v", format, err)
+	}
+}
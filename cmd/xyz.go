@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// xyzCmd represents the xyz command
+var xyzCmd = &cobra.Command{
+	Use:   "xyz",
+	Short: "Produces a z/x/y directory of Web Mercator tiles for web maps and phone apps",
+	Long: `Renders the name-geo-anchored JPG (or GeoTIFF or image with a world
+file, as for the kmz subcommand) into the 256x256 Web Mercator tiles
+web maps and offline phone apps use, e.g.
+
+    cutkmz xyz Grouse-Mountain_49.470628_49.336694_-122.9811_-123.132056.jpg
+
+creates the Grouse-Mountain directory holding a tile z/x/y.png for
+each zoom level z and tile x,y the map reaches, and a tilejson.json
+describing them.
+
+The zoom levels default to from the shallowest showing the map's
+width in one tile to the deepest with at least the image's
+resolution. Give --min_zoom and --max_zoom to choose others, bearing
+in mind each level deeper has four times the tiles. Each level is
+drawn from the image reduced to about its resolution, so its detail
+isn't lost to aliasing.
+
+With --tms, tiles y count north from the south edge, as TMS servers
+and some apps such as older OsmAnd expect, instead of south from the
+north. Areas of tiles the map doesn't cover are transparent, or
+white with --format jpg.
+`,
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processXYZ(viper.GetViper(), args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "see 'cutkmz xyz -h' for help\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(xyzCmd)
+
+	xyzCmd.Flags().Int("min_zoom", -1, "shallowest zoom level to make tiles for. -1 means the one showing the map's width in one tile.")
+	viper.BindPFlag("min_zoom", xyzCmd.Flags().Lookup("min_zoom"))
+
+	xyzCmd.Flags().Int("max_zoom", -1, "deepest zoom level to make tiles for, up to 22. -1 means the one with at least the image's resolution.")
+	viper.BindPFlag("max_zoom", xyzCmd.Flags().Lookup("max_zoom"))
+
+	xyzCmd.Flags().Bool("tms", false, "Number tiles y from the south (TMS) rather than the north (XYZ).")
+	viper.BindPFlag("tms", xyzCmd.Flags().Lookup("tms"))
+
+	xyzCmd.Flags().String("format", "png", "tile image format: png or jpg.")
+	viper.BindPFlag("format", xyzCmd.Flags().Lookup("format"))
+
+	xyzCmd.Flags().StringP("out", "o", "", "directory to write the tiles to. Default is the map's name.")
+	viper.BindPFlag("out", xyzCmd.Flags().Lookup("out"))
+
+	xyzCmd.Flags().Int("src_crs", 0, "EPSG code of a projected world file or GeoTIFF, e.g. 32610 for UTM zone 10N. Reprojects to lat/long.")
+	viper.BindPFlag("src_crs", xyzCmd.Flags().Lookup("src_crs"))
+
+	xyzCmd.Flags().BoolP("keep_tmp", "k", false, "Don't delete intermediate files from $TMPDIR.")
+	viper.BindPFlag("keep_tmp", xyzCmd.Flags().Lookup("keep_tmp"))
+
+	xyzCmd.Flags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		viper.BindPFlag(f.Name, xyzCmd.Flags().Lookup(f.Name))
+	})
+	flag.CommandLine.Parse(nil) // shut up 'not parsed' complaints
+}
+
+// tileJSON is the TileJSON 3.0.0 description of a tile directory
+type tileJSON struct {
+	TileJSON string    `json:"tilejson"`
+	Name     string    `json:"name"`
+	Scheme   string    `json:"scheme"`
+	Tiles    []string  `json:"tiles"`
+	MinZoom  int       `json:"minzoom"`
+	MaxZoom  int       `json:"maxzoom"`
+	Bounds   []float64 `json:"bounds"` // west, south, east, north
+	Center   []float64 `json:"center"` // long, lat, zoom
+}
+
+// processXYZ renders each image in args into a directory of Web
+// Mercator tiles. Uses "min_zoom", "max_zoom", "tms", "format",
+// "out", "src_crs" and "keep_tmp" from viper if present.
+func processXYZ(v *viper.Viper, args []string) error {
+	tms := v.GetBool("tms")
+	format := v.GetString("format")
+	out := v.GetString("out")
+	keepTmp := v.GetBool("keep_tmp")
+	ib, err := newImageBackend(v.GetString("backend"))
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("Image file required: must provide one or more image file path")
+	}
+	if len(args) > 1 && out != "" {
+		return fmt.Errorf("Only one image at a time can be tiled to an --out directory")
+	}
+	if !validWebTileFormat(format) {
+		return fmt.Errorf("Tile format must be one of %v, got %q", webTileFormats, format)
+	}
+	for _, image := range args {
+		if _, err := os.Stat(image); os.IsNotExist(err) {
+			return err
+		}
+		tmpDir, err := ioutil.TempDir("", "cutkmz-")
+		if err != nil {
+			return fmt.Errorf("Error creating a temporary directory: %v", err)
+		}
+		base, img, box, err := latLongMap(ib, tmpDir, image, v.GetInt("src_crs"))
+		if err != nil {
+			return err
+		}
+		width, _, err := ib.Identify(img)
+		if err != nil {
+			return err
+		}
+		minZ, maxZ, err := zoomFlags(v, width, box)
+		if err != nil {
+			return err
+		}
+		dir := out
+		if dir == "" {
+			dir = base
+		}
+		n, err := renderWebTiles(ib, img, tmpDir, box, minZ, maxZ, format, func(t webTile, b []byte) error {
+			y := t.y
+			if tms {
+				y = 1<<uint(t.z) - 1 - t.y
+			}
+			tdir := filepath.Join(dir, fmt.Sprint(t.z), fmt.Sprint(t.x))
+			if err := os.MkdirAll(tdir, 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(tdir, fmt.Sprintf("%d.%s", y, format)), b, 0644)
+		})
+		if err != nil {
+			return err
+		}
+		if err = writeTileJSON(filepath.Join(dir, "tilejson.json"), base, box, minZ, maxZ, tms, format); err != nil {
+			return err
+		}
+		fmt.Printf("%v: %d tiles, zoom %d to %d\n", dir, n, minZ, maxZ)
+
+		if !keepTmp {
+			if err = os.RemoveAll(tmpDir); err != nil {
+				return fmt.Errorf("Error removing tmp dir & contents: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeTileJSON writes the TileJSON of the tiles of the named map
+// covering box to fpath, with tile URLs relative to it
+func writeTileJSON(fpath, name string, box []float64, minZ, maxZ int, tms bool, format string) error {
+	scheme := "xyz"
+	if tms {
+		scheme = "tms"
+	}
+	lon, lat := boxCenter(box)
+	tj := tileJSON{
+		TileJSON: "3.0.0",
+		Name:     name,
+		Scheme:   scheme,
+		Tiles:    []string{"{z}/{x}/{y}." + format},
+		MinZoom:  minZ,
+		MaxZoom:  maxZ,
+		Bounds:   []float64{box[west], box[south], box[east], box[north]},
+		Center:   []float64{lon, lat, float64(minZ)},
+	}
+	b, err := json.MarshalIndent(&tj, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fpath, append(b, '\n'), 0644)
+}
@@ -23,7 +23,9 @@
 // Garmin GPS devices can handle.  The bigkmz subcommand produces
 // higher resolution KMZs suitable for use with Google Earth etc.
 //
-// This software requires ImageMagick to be installed on your system.
+// The image work is done with ImageMagick, GraphicsMagick or libvips
+// if one is installed on your system, otherwise in-process. See the
+// --backend flag.
 //
 // Get cutkmz (ensure you have Go installed already #golang):
 //